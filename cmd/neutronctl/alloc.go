@@ -0,0 +1,157 @@
+// copyright @ 2020 ops inc.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"neutron/pkg/config"
+	"neutron/pkg/etcd"
+	"neutron/pkg/store"
+)
+
+func listAllocations(ctx context.Context, backend store.Backend, service string) ([]etcd.Allocation, error) {
+	ipStore, err := backend.Open(ctx, service, "")
+	if err != nil {
+		return nil, err
+	}
+	defer ipStore.Close()
+
+	allocations, err := ipStore.ListAllocations(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(allocations, func(i, j int) bool {
+		return bytes.Compare(allocations[i].IP.To16(), allocations[j].IP.To16()) < 0
+	})
+	return allocations, nil
+}
+
+func allocList(ctx context.Context, backend store.Backend, args []string) error {
+	allocations, err := listAllocations(ctx, backend, args[0])
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "IP\tHOST\tNAMESPACE\tPOD\tCONTAINER\tIFNAME\tALLOCATED")
+	for _, alloc := range allocations {
+		rec := alloc.Record
+		allocated := "-"
+		if !rec.AllocatedAt.IsZero() {
+			allocated = rec.AllocatedAt.Format(time.RFC3339)
+		}
+		container := orDash(rec.ContainerID)
+		if rec.Held() {
+			container = "held until " + rec.HeldUntil.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", alloc.IP, rec.Host, orDash(rec.PodNamespace),
+			orDash(rec.PodName), container, orDash(rec.IfName), allocated)
+	}
+	return w.Flush()
+}
+
+func allocStats(ctx context.Context, backend store.Backend, args []string) error {
+	service := args[0]
+	data, err := backend.GetServiceConf(ctx, service)
+	if err != nil {
+		return err
+	}
+	n, err := config.ReadTotalConf(data)
+	if err != nil {
+		return err
+	}
+	ipamConf, _, err := config.LoadIPAMConfig(n, nil)
+	if err != nil {
+		return err
+	}
+
+	allocations, err := listAllocations(ctx, backend, service)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "SET\tRANGE\tSUBNET\tTOTAL\tUSED\tFREE")
+	outside := 0
+	for _, alloc := range allocations {
+		found := false
+		for _, rangeset := range ipamConf.Ranges {
+			if rangeset.Contains(alloc.IP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			outside++
+		}
+	}
+	for idx, rangeset := range ipamConf.Ranges {
+		for _, r := range rangeset {
+			total := rangeSize(&r)
+			used := 0
+			for _, alloc := range allocations {
+				if r.Contains(alloc.IP) {
+					used++
+				}
+			}
+			free := new(big.Int).Sub(total, big.NewInt(int64(used)))
+			subnet := (*net.IPNet)(&r.Subnet)
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%s\n", idx, r.String(), subnet.String(), total, used, free)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if outside > 0 {
+		fmt.Printf("%d allocations are outside of the configured ranges\n", outside)
+	}
+	return nil
+}
+
+// allocIndex 为服务已有的分配建立容器索引, 所有节点升级后执行一次; 之后按容器查找不再扫描整个服务
+func allocIndex(ctx context.Context, backend store.Backend, args []string) error {
+	ipStore, err := backend.Open(ctx, args[0], "")
+	if err != nil {
+		return err
+	}
+	defer ipStore.Close()
+
+	indexer, ok := ipStore.(store.Indexer)
+	if !ok {
+		fmt.Println("store does not need an index")
+		return nil
+	}
+	if err := indexer.BuildIndex(ctx); err != nil {
+		return err
+	}
+	fmt.Printf("service %s indexed\n", args[0])
+	return nil
+}
+
+// rangeSize range内可分配的ip数量(不含网关)
+func rangeSize(r *config.Range) *big.Int {
+	start := new(big.Int).SetBytes(r.RangeStart.To16())
+	end := new(big.Int).SetBytes(r.RangeEnd.To16())
+	size := new(big.Int).Sub(end, start)
+	size.Add(size, big.NewInt(1))
+	if r.Contains(r.Gateway) {
+		size.Sub(size, big.NewInt(1))
+	}
+	return size
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,110 @@
+// copyright @ 2020 ops inc.
+
+// neutronctl 运维工具: 查看、修改服务配置, 查看ip分配情况
+//
+//	neutronctl [-conf file] service list
+//	neutronctl [-conf file] service get <service>
+//	neutronctl [-conf file] service set <service> <file|->
+//	neutronctl [-conf file] service validate <file|->
+//	neutronctl [-conf file] alloc list <service>
+//	neutronctl [-conf file] alloc stats <service>
+//	neutronctl [-conf file] alloc index <service>
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"neutron/pkg/config"
+	"neutron/pkg/log"
+	"neutron/pkg/store"
+)
+
+const defaultConfFile = "/etc/cni/net.d/10-maclannet.conf"
+
+type command struct {
+	nargs int
+	usage string
+	run   func(ctx context.Context, backend store.Backend, args []string) error
+}
+
+var commands = map[string]map[string]command{
+	"service": {
+		"list":     {0, "service list", serviceList},
+		"get":      {1, "service get <service>", serviceGet},
+		"set":      {2, "service set <service> <file|->", serviceSet},
+		"validate": {1, "service validate <file|->", serviceValidate},
+	},
+	"alloc": {
+		"list":  {1, "alloc list <service>", allocList},
+		"stats": {1, "alloc stats <service>", allocStats},
+		"index": {1, "alloc index <service>", allocIndex},
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: neutronctl [-conf file] <command>\n\nCommands:\n")
+	for _, group := range []string{"service", "alloc"} {
+		for _, name := range []string{"list", "get", "set", "validate", "stats", "index"} {
+			if cmd, ok := commands[group][name]; ok {
+				fmt.Fprintf(os.Stderr, "  %s\n", cmd.usage)
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	confFile := flag.String("conf", defaultConfFile, "neutron local config file")
+	flag.Usage = usage
+	flag.Parse()
+	log.InitCliLogger()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[args[0]][args[1]]
+	if !ok || len(args)-2 != cmd.nargs {
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(*confFile, cmd, args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "neutronctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(confFile string, cmd command, args []string) error {
+	data, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		return err
+	}
+	conf, err := config.ReadLocalConf(data)
+	if err != nil {
+		return err
+	}
+	backend, err := store.New(conf)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	ctx, cancel := conf.Context()
+	defer cancel()
+	return cmd.run(ctx, backend, args)
+}
+
+// readInput 读取文件内容, "-"表示从stdin读取
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(path)
+}
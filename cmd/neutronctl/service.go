@@ -0,0 +1,96 @@
+// copyright @ 2020 ops inc.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"neutron/pkg/config"
+	"neutron/pkg/store"
+)
+
+func serviceList(ctx context.Context, backend store.Backend, args []string) error {
+	services, err := backend.ListServices(ctx)
+	if err != nil {
+		return err
+	}
+	for _, service := range services {
+		fmt.Println(service)
+	}
+	return nil
+}
+
+func serviceGet(ctx context.Context, backend store.Backend, args []string) error {
+	data, err := backend.GetServiceConf(ctx, args[0])
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		// 非法json原样输出, 方便排查
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Println(out.String())
+	return nil
+}
+
+func serviceSet(ctx context.Context, backend store.Backend, args []string) error {
+	service := args[0]
+	data, err := readInput(args[1])
+	if err != nil {
+		return err
+	}
+	if err := validateServiceConf(data); err != nil {
+		return fmt.Errorf("invalid config for service %s: %v", service, err)
+	}
+
+	// 以紧凑格式写入, 与手工etcdctl put的格式保持一致
+	var out bytes.Buffer
+	if err := json.Compact(&out, data); err != nil {
+		return err
+	}
+	if err := backend.PutServiceConf(ctx, service, out.Bytes()); err != nil {
+		return err
+	}
+	fmt.Printf("service %s config updated\n", service)
+	return nil
+}
+
+func serviceValidate(ctx context.Context, backend store.Backend, args []string) error {
+	data, err := readInput(args[0])
+	if err != nil {
+		return err
+	}
+	if err := validateServiceConf(data); err != nil {
+		if verr, ok := err.(*config.ValidationError); ok {
+			for _, problem := range verr.Problems {
+				fmt.Println(problem)
+			}
+		}
+		return err
+	}
+	fmt.Println("config is valid")
+	return nil
+}
+
+// validateServiceConf 与cmdAdd相同的方式解析并校验服务配置
+func validateServiceConf(data []byte) error {
+	n, err := config.ReadTotalConf(data)
+	if err != nil {
+		return err
+	}
+	if err := config.Validate(n); err != nil {
+		return err
+	}
+	if n.IPAM.Type != "" {
+		if _, _, err := config.LoadIPAMConfig(n, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+// copyright @ 2020 ops inc.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"neutron/pkg/cache"
+	"neutron/pkg/ipam"
+	"neutron/pkg/log"
+	"neutron/pkg/store"
+)
+
+const (
+	defaultConfFile = "/etc/cni/net.d/10-maclannet.conf"
+
+	// gcVerbMinAge GC动作中跳过刚分配的记录, 避免与正在进行的ADD冲突
+	gcVerbMinAge = time.Minute
+)
+
+// cmdGC neutron gc子命令: 回收当前主机上容器已不存在的ip
+//
+//	neutron gc [-conf file] [-dry-run] [-valid-ids id1,id2] [-valid-ids-file file] [-min-age 5m]
+func cmdGC(argv []string) error {
+	fs := flag.NewFlagSet("gc", flag.ContinueOnError)
+	confFile := fs.String("conf", defaultConfFile, "neutron local config file")
+	dryRun := fs.Bool("dry-run", false, "only report leaked ips, do not release them")
+	validIDs := fs.String("valid-ids", "", "comma separated list of live container ids")
+	validIDsFile := fs.String("valid-ids-file", "", "file with one live container id per line")
+	minAge := fs.Duration("min-age", 5*time.Minute, "skip allocations younger than this")
+	if err := fs.Parse(argv); err != nil {
+		return err
+	}
+
+	data, err := ioutil.ReadFile(*confFile)
+	if err != nil {
+		return err
+	}
+	backend, localConf, err := getBackend(data)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	opts := &ipam.GCOptions{
+		Host:   hostname,
+		MinAge: *minAge,
+		DryRun: *dryRun,
+	}
+	if *validIDs != "" || *validIDsFile != "" {
+		opts.ValidIDs, err = loadValidIDs(*validIDs, *validIDsFile)
+		if err != nil {
+			return err
+		}
+		log.Infof("GC load %d valid container ids", len(opts.ValidIDs))
+	}
+
+	// 命令行gc遍历所有服务, 不限制总时间, 每次请求仍有etcd的requestTimeout
+	if !*dryRun {
+		replayReleases(context.Background(), backend, cache.New(localConf.CacheDir()))
+	}
+	report, err := ipam.ExecGC(context.Background(), backend, opts)
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("gc finished with %d errors", len(report.Errors))
+	}
+	return nil
+}
+
+// cmdGarbageCollect CNI 1.1 GC: 运行时传入仍然存活的attachment, 回收当前主机上其余的ip
+func cmdGarbageCollect(args *skel.CmdArgs) error {
+	backend, localConf, err := getBackend(args.StdinData)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	opts := &ipam.GCOptions{
+		Host:     hostname,
+		ValidIDs: map[string]bool{},
+		MinAge:   gcVerbMinAge,
+	}
+	for _, attachment := range localConf.ValidAttachments {
+		opts.ValidIDs[attachment.ContainerID] = true
+	}
+
+	ctx, cancel := localConf.Context()
+	defer cancel()
+	resultCache := cache.New(localConf.CacheDir())
+	replayReleases(ctx, backend, resultCache)
+	report, err := ipam.ExecGC(ctx, backend, opts)
+	if err != nil {
+		return err
+	}
+	pruneResults(resultCache, opts)
+	if len(report.Errors) > 0 {
+		return fmt.Errorf("gc finished with %d errors: %s", len(report.Errors), strings.Join(report.Errors, "; "))
+	}
+	return nil
+}
+
+// replayReleases 重放etcd不可用时DEL未能释放的ip, 失败的保留到下次重放
+func replayReleases(ctx context.Context, backend store.Backend, resultCache *cache.Cache) {
+	pending, err := resultCache.Pending()
+	if err != nil {
+		log.Warnf("Replay list pending releases failed: %v", err)
+		return
+	}
+	for _, e := range pending {
+		if ctx.Err() != nil {
+			return
+		}
+		n, err := parseConf(e.Config)
+		if err != nil {
+			// 缓存的配置无法解析, 按分配记录释放
+			log.Warnf("Replay release container: %s invalid cached config: %v, release by allocation records", e.ContainerID, err)
+			n = nil
+		}
+		args := &skel.CmdArgs{ContainerID: e.ContainerID, IfName: e.IfName, Netns: e.Netns}
+		if err := ipam.ExecDel(ctx, backend, e.Identity(), n, args); err != nil {
+			log.Warnf("Replay release container: %s failed: %v", e.ContainerID, err)
+			continue
+		}
+		if err := resultCache.Done(e); err != nil {
+			log.Warnf("Replay remove pending release failed: %v", err)
+			continue
+		}
+		log.Infof("Replay release container: %s service: %s success", e.ContainerID, e.Service)
+	}
+}
+
+// pruneResults 删除已不存活的容器的缓存结果, 跳过刚写入的记录避免与正在进行的ADD冲突
+func pruneResults(resultCache *cache.Cache, opts *ipam.GCOptions) {
+	entries, err := resultCache.List()
+	if err != nil {
+		log.Warnf("GC list cached results failed: %v", err)
+		return
+	}
+	for _, e := range entries {
+		if opts.ValidIDs[e.ContainerID] || time.Since(e.Created) < opts.MinAge {
+			continue
+		}
+		if err := resultCache.Remove(e.ContainerID, e.IfName); err != nil {
+			log.Warnf("GC remove cached result of container: %s failed: %v", e.ContainerID, err)
+			continue
+		}
+		log.Infof("GC remove cached result of container: %s", e.ContainerID)
+	}
+}
+
+// loadValidIDs 合并命令行和文件中的存活container id
+func loadValidIDs(ids, file string) (map[string]bool, error) {
+	result := map[string]bool{}
+	for _, id := range strings.Split(ids, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			result[id] = true
+		}
+	}
+	if file == "" {
+		return result, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if id := strings.TrimSpace(scanner.Text()); id != "" {
+			result[id] = true
+		}
+	}
+	return result, scanner.Err()
+}
@@ -1,28 +1,56 @@
 module neutron
 
-go 1.14
+go 1.21
 
 require (
-	github.com/containernetworking/cni v0.8.0
-	github.com/containernetworking/plugins v0.8.6
+	github.com/containernetworking/cni v1.2.3
+	github.com/containernetworking/plugins v1.4.0
 	github.com/coreos/etcd v3.3.22+incompatible
-	github.com/coreos/go-iptables v0.4.5
+	github.com/j-keck/arping v1.0.2
+	github.com/sirupsen/logrus v1.9.0
+	github.com/vishvananda/netlink v1.2.1-beta.2
+	google.golang.org/grpc v1.56.3 // 仅为满足依赖的最低版本, 实际编译使用replace固定的v1.26.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/coreos/bbolt v1.3.2 // indirect
+	github.com/coreos/go-iptables v0.7.0 // indirect
 	github.com/coreos/go-semver v0.3.0 // indirect
+	github.com/coreos/go-systemd v0.0.0-20190321100706-95778dfbb74e // indirect
 	github.com/coreos/pkg v0.0.0-20180928190104-399ea9e2e55f // indirect
-	github.com/gogo/protobuf v1.3.1 // indirect
-	github.com/golang/protobuf v1.4.2 // indirect
-	github.com/google/go-cmp v0.5.0 // indirect
-	github.com/google/uuid v1.1.1 // indirect
-	github.com/j-keck/arping v1.0.1
-	github.com/onsi/ginkgo v0.0.0-20151202141238-7f8ab55aaf3b
-	github.com/onsi/gomega v0.0.0-20151007035656-2152b45fa28a
-	github.com/rogpeppe/godef v1.1.2 // indirect
-	github.com/safchain/ethtool v0.0.0-20200609180057-ab94f15152e7
-	github.com/sirupsen/logrus v1.6.0
-	github.com/vishvananda/netlink v1.1.0
-	go.uber.org/zap v1.15.0 // indirect
-	golang.org/x/net v0.0.0-20200707034311-ab3426394381 // indirect
-	golang.org/x/sys v0.0.0-20200724161237-0e2f3a69832c
-	golang.org/x/text v0.3.3 // indirect
-	google.golang.org/grpc v1.26.0 // indirect
+	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
+	github.com/dustin/go-humanize v1.0.0 // indirect
+	github.com/gogo/protobuf v1.3.2 // indirect
+	github.com/golang/glog v1.0.0 // indirect
+	github.com/golang/protobuf v1.5.3 // indirect
+	github.com/google/btree v1.0.1 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/grpc-ecosystem/go-grpc-middleware v1.3.0 // indirect
+	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0 // indirect
+	github.com/grpc-ecosystem/grpc-gateway v1.16.0 // indirect
+	github.com/jonboulle/clockwork v0.2.2 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.4 // indirect
+	github.com/prometheus/client_golang v1.12.2 // indirect
+	github.com/safchain/ethtool v0.3.0 // indirect
+	github.com/soheilhy/cmux v0.1.5 // indirect
+	github.com/stretchr/testify v1.8.4 // indirect
+	github.com/tmc/grpc-websocket-proxy v0.0.0-20201229170055-e5319fda7802 // indirect
+	github.com/vishvananda/netns v0.0.4 // indirect
+	github.com/xiang90/probing v0.0.0-20190116061207-43a291ad63a2 // indirect
+	go.uber.org/atomic v1.7.0 // indirect
+	go.uber.org/multierr v1.6.0 // indirect
+	go.uber.org/zap v1.17.0 // indirect
+	golang.org/x/net v0.25.0 // indirect
+	golang.org/x/sys v0.20.0 // indirect
+	golang.org/x/text v0.15.0 // indirect
+	golang.org/x/time v0.3.0 // indirect
+	google.golang.org/genproto v0.0.0-20230410155749-daa745c078e1 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+	sigs.k8s.io/yaml v1.2.0 // indirect
 )
+
+// etcd v3.3的clientv3依赖grpc/naming, grpc需固定在v1.26.0
+replace google.golang.org/grpc => google.golang.org/grpc v1.26.0
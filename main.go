@@ -15,33 +15,41 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
 	"github.com/containernetworking/plugins/pkg/ip"
 	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/containernetworking/plugins/pkg/utils/buildversion"
 	"github.com/containernetworking/plugins/pkg/utils/sysctl"
-	"github.com/coreos/etcd/clientv3"
 	"github.com/j-keck/arping"
 	"github.com/vishvananda/netlink"
 
+	"neutron/pkg/cache"
 	"neutron/pkg/config"
 	"neutron/pkg/etcd"
 	"neutron/pkg/ipam"
 	"neutron/pkg/log"
+	"neutron/pkg/store"
+	"neutron/pkg/util"
 )
 
 const (
 	IPv4InterfaceArpProxySysctlTemplate = "net.ipv4.conf.%s.proxy_arp"
+
+	// errPluginNotAvailable CNI 1.1 STATUS: 插件当前无法处理ADD
+	errPluginNotAvailable uint = 50
 )
 
 func init() {
@@ -54,40 +62,97 @@ func init() {
 }
 
 func main() {
-	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All, buildversion.BuildString("macvlan"))
+	// neutron gc: 回收泄漏的ip, 其余情况作为CNI插件运行
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		if err := cmdGC(os.Args[2:]); err != nil {
+			fmt.Fprintf(os.Stderr, "neutron gc: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	skel.PluginMainFuncs(skel.CNIFuncs{
+		Add:    cmdAdd,
+		Del:    cmdDel,
+		Check:  cmdCheck,
+		GC:     cmdGarbageCollect,
+		Status: cmdStatus,
+	}, version.All, buildversion.BuildString("macvlan"))
 }
 
-func getClient(bytes []byte) (*clientv3.Client, error) {
+// getBackend 根据本地配置创建存储后端(默认etcd)
+func getBackend(bytes []byte) (store.Backend, *config.LocalConf, error) {
 	conf, err := config.ReadLocalConf(bytes)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	backend, err := store.New(conf)
+	if err != nil {
+		return nil, nil, err
 	}
+	return backend, conf, nil
+}
 
-	etcdConf := etcd.NewEtcdConf()
-	client, err := etcdConf.Connect(conf.Etcd.URLs, conf.Etcd.CAFile, conf.Etcd.KeyFile, conf.Etcd.CertFile)
+// getIdentity 解析CNI_ARGS, 并按本地配置的identity获取当前pod的服务名和发布阶段
+func getIdentity(conf *config.LocalConf, envArgs string) (*util.Identity, error) {
+	cniArgs, err := util.ParseCNIArgs(envArgs)
 	if err != nil {
 		return nil, err
 	}
-	return client, nil
+	ident, err := conf.Identity.Resolve(cniArgs, conf.RuntimeConfig.Labels, conf.RuntimeConfig.Annotations)
+	if err != nil {
+		return nil, types.NewError(types.ErrInvalidEnvironmentVariables, "failed to get service of pod", err.Error())
+	}
+	return ident, nil
+}
+
+// parsePrevResult 解析运行时传入的上一次ADD结果(0.4.0及以上), 未传入时返回nil
+func parsePrevResult(conf *types.NetConf) (*current.Result, error) {
+	if conf.RawPrevResult == nil {
+		return nil, nil
+	}
+	if err := version.ParsePrevResult(conf); err != nil {
+		return nil, err
+	}
+	return current.NewResultFromResult(conf.PrevResult)
 }
 
 // NOTE: 修改loadConf
-func loadConf(client *clientv3.Client, envArgs string) (*config.NetConf, string, error) {
-	etcdConf := etcd.NewEtcdConf()
-	conf, err := etcdConf.GetServiceConf(client, envArgs)
+// loadConf 从存储读取服务配置, 同时返回原始配置用于写入本地缓存
+func loadConf(ctx context.Context, backend store.Backend, service string) (*config.NetConf, []byte, error) {
+	conf, err := backend.GetServiceConf(ctx, service)
+	if err != nil {
+		return nil, nil, err
+	}
+	n, err := parseConf(conf)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
+	return n, conf, nil
+}
 
+// parseConf 解析服务配置(来自存储或本地缓存)并补全默认值
+func parseConf(conf []byte) (*config.NetConf, error) {
 	n, err := config.ReadTotalConf(conf)
+	if err != nil {
+		return nil, err
+	}
 	if n.Master == "" {
 		defaultRouteInterface, err := getDefaultRouteInterfaceName()
 		if err != nil {
-			return nil, "", err
+			return nil, err
 		}
 		n.Master = defaultRouteInterface
 	}
-	return n, n.CNIVersion, nil
+
+	// macvlan模式, 未配置时默认bridge
+	if n.Mode == "" {
+		n.Mode = "bridge"
+	}
+	if _, err := modeFromString(n.Mode); err != nil {
+		return nil, err
+	}
+	return n, nil
 }
 
 func getDefaultRouteInterfaceName() (string, error) {
@@ -110,22 +175,39 @@ func getDefaultRouteInterfaceName() (string, error) {
 }
 
 // Equivalent to: `ip link add link bond0 name mac1 type macvlan mode bridge`
-func createMacvlan(conf *config.NetConf, ifName string, netns ns.NetNS) (*current.Interface, error) {
-	macvlan := &current.Interface{}
-
-	mode, _ := modeFromString()
-	log.Infof("Cmd add create macvlan master is: %s", conf.Master)
-	m, err := netlink.LinkByName(conf.Master)
+// 自动创建的vlan接口和新建的macvlan登记到undo中, ADD后续步骤失败时删除
+func (o *addOps) createMacvlan(conf *config.NetConf, ifName string, netns ns.NetNS, undo *util.Undo) (*current.Interface, error) {
+	mode, err := modeFromString(conf.Mode)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Cmd add create macvlan master is: %s mode is: %s", conf.Master, conf.Mode)
+	m, err := o.linkByName(conf.Master)
 	if err != nil {
 		log.Infof("Cmd add link %s: %s", conf.Master, err)
-		if err.Error() == "Link not found" {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
 			log.Infof("Cmd add begin create vlan interface: %s", conf.Master)
-			m, err = createVlanInterface(conf)
+			m, err = o.createVlanInterface(conf, undo)
 		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to lookup master %q: %v", conf.Master, err)
 		}
 	}
+	return o.addMacvlan(conf, mode, m, ifName, netns, undo)
+}
+
+// addMacvlan 在容器内创建挂在master上的macvlan, 新建的登记到undo中
+func addMacvlan(conf *config.NetConf, mode netlink.MacvlanMode, m netlink.Link, ifName string, netns ns.NetNS, undo *util.Undo) (*current.Interface, error) {
+	macvlan := &current.Interface{}
+
+	// 运行时重试ADD时容器内可能已有该网卡, 复用的网卡不是本次创建的, 失败时不删除
+	existing, err := reconcileMacvlan(conf, mode, m, ifName, netns)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return existing, nil
+	}
 
 	// due to kernel bug we have to create with tmpName or it might
 	// collide with the name on the host and error out
@@ -148,23 +230,32 @@ func createMacvlan(conf *config.NetConf, ifName string, netns ns.NetNS) (*curren
 	if err := netlink.LinkAdd(mv); err != nil {
 		return nil, fmt.Errorf("failed to create macvlan: %v", err)
 	}
-	log.Infof("Cmd add ip link add link %s dev %s type macvlan mode bridge", conf.Master, tmpName)
+	log.Infof("Cmd add ip link add link %s dev %s type macvlan mode %s", conf.Master, tmpName, conf.Mode)
 	log.Infof("Cmd add create macvlan: %s success", tmpName)
 
+	// 重命名之前网卡名是tmpName
+	curName := tmpName
+	undo.Push("macvlan "+ifName, func() error {
+		return netns.Do(func(_ ns.NetNS) error {
+			if err := ip.DelLinkByName(curName); err != nil && err != ip.ErrLinkNotFound {
+				return err
+			}
+			return nil
+		})
+	})
+
 	err = netns.Do(func(_ ns.NetNS) error {
 		// TODO: duplicate following lines for ipv6 support, when it will be added in other places
 		ipv4SysctlValueName := fmt.Sprintf(IPv4InterfaceArpProxySysctlTemplate, tmpName)
 		if _, err := sysctl.Sysctl(ipv4SysctlValueName, "1"); err != nil {
-			// remove the newly added link and ignore errors, because we already are in a failed state
-			_ = netlink.LinkDel(mv)
 			return fmt.Errorf("failed to set proxy_arp on newly added interface %q: %v", tmpName, err)
 		}
 
 		err := ip.RenameLink(tmpName, ifName)
 		if err != nil {
-			_ = netlink.LinkDel(mv)
 			return fmt.Errorf("failed to rename macvlan to %q: %v", ifName, err)
 		}
+		curName = ifName
 		macvlan.Name = ifName
 		log.Infof("Cmd add rename macvlan name is: %s", ifName)
 
@@ -174,6 +265,7 @@ func createMacvlan(conf *config.NetConf, ifName string, netns ns.NetNS) (*curren
 			return fmt.Errorf("failed to refetch macvlan %q: %v", ifName, err)
 		}
 		macvlan.Mac = contMacvlan.Attrs().HardwareAddr.String()
+		macvlan.Mtu = contMacvlan.Attrs().MTU
 		macvlan.Sandbox = netns.Path()
 
 		return nil
@@ -185,16 +277,79 @@ func createMacvlan(conf *config.NetConf, ifName string, netns ns.NetNS) (*curren
 	return macvlan, nil
 }
 
-func modeFromString() (netlink.MacvlanMode, error) {
-	return netlink.MACVLAN_MODE_BRIDGE, nil
+// reconcileMacvlan 容器内已有名为ifName的网卡时: 是挂在master上且模式一致的macvlan则直接复用,
+// 否则删除后重新创建. 没有该网卡时返回nil
+func reconcileMacvlan(conf *config.NetConf, mode netlink.MacvlanMode, master netlink.Link, ifName string, netns ns.NetNS) (*current.Interface, error) {
+	var macvlan *current.Interface
+	err := netns.Do(func(_ ns.NetNS) error {
+		link, err := netlink.LinkByName(ifName)
+		if err != nil {
+			if _, ok := err.(netlink.LinkNotFoundError); ok {
+				return nil
+			}
+			return fmt.Errorf("failed to lookup %q: %v", ifName, err)
+		}
+
+		mv, isMacvlan := link.(*netlink.Macvlan)
+		if isMacvlan && mv.Mode == mode && mv.Attrs().ParentIndex == master.Attrs().Index &&
+			(conf.MTU == 0 || conf.MTU == mv.Attrs().MTU) {
+			log.Infof("Cmd add reuse existing macvlan: %s", ifName)
+			macvlan = &current.Interface{
+				Name:    ifName,
+				Mac:     mv.Attrs().HardwareAddr.String(),
+				Mtu:     mv.Attrs().MTU,
+				Sandbox: netns.Path(),
+			}
+			return nil
+		}
+
+		log.Infof("Cmd add existing interface: %s type: %s does not match config, recreate it", ifName, link.Type())
+		if err := netlink.LinkDel(link); err != nil {
+			return fmt.Errorf("failed to delete existing interface %q: %v", ifName, err)
+		}
+		return nil
+	})
+	return macvlan, err
 }
 
-func modeToString() (string, error) {
-	return "bridge", nil
+func modeFromString(s string) (netlink.MacvlanMode, error) {
+	switch s {
+	case "", "bridge":
+		return netlink.MACVLAN_MODE_BRIDGE, nil
+	case "private":
+		return netlink.MACVLAN_MODE_PRIVATE, nil
+	case "vepa":
+		return netlink.MACVLAN_MODE_VEPA, nil
+	case "passthru":
+		return netlink.MACVLAN_MODE_PASSTHRU, nil
+	case "source":
+		// ADD的校验已拒绝source, 这里保留用于DEL/CHECK之前创建的网卡
+		return netlink.MACVLAN_MODE_SOURCE, nil
+	default:
+		return 0, fmt.Errorf("unknown macvlan mode: %q", s)
+	}
+}
+
+func modeToString(mode netlink.MacvlanMode) (string, error) {
+	switch mode {
+	case netlink.MACVLAN_MODE_BRIDGE:
+		return "bridge", nil
+	case netlink.MACVLAN_MODE_PRIVATE:
+		return "private", nil
+	case netlink.MACVLAN_MODE_VEPA:
+		return "vepa", nil
+	case netlink.MACVLAN_MODE_PASSTHRU:
+		return "passthru", nil
+	case netlink.MACVLAN_MODE_SOURCE:
+		return "source", nil
+	default:
+		return "", fmt.Errorf("unknown macvlan mode: %q", mode)
+	}
 }
 
 // create vlan interface if it not exist. eg bond0.1234
-func createVlanInterface(conf *config.NetConf) (netlink.Link, error) {
+// 创建成功后登记到undo中, ADD失败时删除本次创建的vlan接口
+func (o *addOps) createVlanInterface(conf *config.NetConf, undo *util.Undo) (netlink.Link, error) {
 	intfInfo := strings.Split(conf.Master, ".")
 	if len(intfInfo) != 2 {
 		return nil, fmt.Errorf("Cmd add invalid vlan interface: %s", conf.Master)
@@ -206,7 +361,7 @@ func createVlanInterface(conf *config.NetConf) (netlink.Link, error) {
 	}
 	log.Infof("Cmd add create vlan interface vlan id: %d", vlanId)
 
-	pLink, err := netlink.LinkByName(pName)
+	pLink, err := o.linkByName(pName)
 	if err != nil {
 		return nil, fmt.Errorf("Cmd add can't found parent device: %s", err)
 	}
@@ -223,23 +378,26 @@ func createVlanInterface(conf *config.NetConf) (netlink.Link, error) {
 		},
 		VlanId: vlanId,
 	}
-	if err := netlink.LinkAdd(vl); err != nil {
+	if err := o.linkAdd(vl); err != nil {
 		return nil, fmt.Errorf("Cmd add failed to create vlan: %s", err)
 	}
 	log.Infof("Cmd add ip link add link: %s success", conf.Master)
+	undo.Push("vlan "+conf.Master, func() error {
+		return o.deleteVlanInterface(conf.Master)
+	})
 
 	// step2 启用该vlan接口 类似: ip link set bond0.1234 up
-	mlink, err := netlink.LinkByName(conf.Master)
+	mlink, err := o.linkByName(conf.Master)
 	if err != nil {
 		return nil, err
 	}
-	if err := netlink.LinkSetUp(mlink); err != nil {
+	if err := o.linkSetUp(mlink); err != nil {
 		return nil, fmt.Errorf("Cmd add ip link set %s up failed: %s", conf.Master, err)
 	}
 	log.Infof("Cmd add ip link set %s up", conf.Master)
 
 	// step3 状态更新后，重新取下网卡
-	mlink, err = netlink.LinkByName(conf.Master)
+	mlink, err = o.linkByName(conf.Master)
 	if err != nil {
 		return nil, err
 	}
@@ -247,177 +405,498 @@ func createVlanInterface(conf *config.NetConf) (netlink.Link, error) {
 	return mlink, nil
 }
 
+// deleteVlanInterface 删除自动创建的vlan接口, 接口已不存在时忽略
+func (o *addOps) deleteVlanInterface(name string) error {
+	vlan, err := o.linkByName(name)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
+			return nil
+		}
+		return err
+	}
+	return o.linkDel(vlan)
+}
+
+// cmdAdd 每个生效的副作用(创建vlan、创建macvlan、分配ip、配置地址和路由)都登记到undo中,
+// 任何一步失败(包括输出结果失败)都按相反的顺序撤销, 避免泄漏网卡和ip
 func cmdAdd(args *skel.CmdArgs) error {
 	log.Info("Cmd add begin to create macvlan.")
-	client, err := getClient(args.StdinData)
+	backend, localConf, err := getBackend(args.StdinData)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	// 访问存储的总时间不超过本地配置的timeout, 超时后回滚并返回错误
+	ctx, cancel := localConf.Context()
+	defer cancel()
+
+	ident, err := getIdentity(localConf, args.Args)
 	if err != nil {
 		return err
 	}
 
-	n, cniVersion, err := loadConf(client, args.Args)
+	n, rawConf, err := loadConf(ctx, backend, ident.Service)
 	if err != nil {
 		return err
 	}
+	// 结果按运行时请求的版本(本地配置的cniVersion)输出, 而不是etcd中服务配置的版本
+	cniVersion := localConf.CNIVersion
+	if err := config.Validate(n); err != nil {
+		log.Errorf("Cmd add validate service config failed: %v", err)
+		return types.NewError(types.ErrInvalidNetworkConfig, "invalid service config", err.Error())
+	}
 	log.Infof("Cmd add get plugin cni version: %s", cniVersion)
 
-	isLayer3 := n.IPAM.Type != ""
-	log.Infof("Cmd add current isLayer3=%t", isLayer3)
+	resultCache := cache.New(localConf.CacheDir())
+	// 存储可用, 重放之前etcd不可用时DEL未能释放的ip; 时间有单独的上限, etcd较慢时不影响本次ADD
+	replayCtx, replayCancel := util.ReplayContext(ctx)
+	replayReleases(replayCtx, backend, resultCache)
+	replayCancel()
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
-		return fmt.Errorf("failed to open netns %q: %v", netns, err)
+		return fmt.Errorf("failed to open netns %q: %v", args.Netns, err)
 	}
 	defer netns.Close()
 
-	macvlanInterface, err := createMacvlan(n, args.IfName, netns)
-	if err != nil {
-		return err
+	// 每一步生效的副作用登记到undo中, 某一步失败时在netns关闭之前按相反的顺序撤销
+	req := &addRequest{
+		ctx:        ctx,
+		backend:    backend,
+		ident:      ident,
+		conf:       n,
+		rawConf:    rawConf,
+		args:       args,
+		netns:      netns,
+		cache:      resultCache,
+		cniVersion: cniVersion,
+		result:     &current.Result{CNIVersion: cniVersion},
 	}
+	return runAddSteps(defaultAddOps.newAddSteps(req))
+}
 
-	// Delete link if err to avoid link leak in this ns
-	defer func() {
-		if err != nil {
-			netns.Do(func(_ ns.NetNS) error {
-				return ip.DelLinkByName(args.IfName)
-			})
-		}
-	}()
+// addRequest 一次ADD的参数, result由各步骤依次填充
+type addRequest struct {
+	ctx        context.Context
+	backend    store.Backend
+	ident      *util.Identity
+	conf       *config.NetConf
+	rawConf    []byte
+	args       *skel.CmdArgs
+	netns      ns.NetNS
+	cache      *cache.Cache
+	cniVersion string
+	result     *current.Result
+}
 
-	// Assume L2 interface only
-	result := &current.Result{CNIVersion: cniVersion, Interfaces: []*current.Interface{macvlanInterface}}
+// addOps ADD中访问内核网卡和ipam的操作, 测试时替换以注入失败, 检查各步骤登记的撤销操作
+type addOps struct {
+	linkByName func(name string) (netlink.Link, error)
+	linkAdd    func(link netlink.Link) error
+	linkSetUp  func(link netlink.Link) error
+	linkDel    func(link netlink.Link) error
 
-	if isLayer3 {
-		log.Infof("Cmd add invoke ipam to allocate ip")
-		// run the IPAM plugin and get back the config to apply
-		r, err := ipam.ExecAdd(client, n, args)
-		if err != nil {
-			return err
-		}
-		log.Infof("Cmd add allocate ip success")
+	addMacvlan     func(conf *config.NetConf, mode netlink.MacvlanMode, m netlink.Link, ifName string, netns ns.NetNS, undo *util.Undo) (*current.Interface, error)
+	configureIface func(ifName string, netns ns.NetNS, result *current.Result, undo *util.Undo) error
+	setIfaceUp     func(ifName string, netns ns.NetNS) error
 
-		// Invoke ipam del if err to avoid ip leak
-		defer func() {
+	execAdd     func(ctx context.Context, backend store.Backend, ident *util.Identity, conf *config.NetConf, args *skel.CmdArgs) (*current.Result, []net.IP, error)
+	execRelease func(ctx context.Context, backend store.Backend, ident *util.Identity, conf *config.NetConf, args *skel.CmdArgs, prior []net.IP) error
+	printResult func(result types.Result, version string) error
+}
+
+var defaultAddOps = &addOps{
+	linkByName:     netlink.LinkByName,
+	linkAdd:        netlink.LinkAdd,
+	linkSetUp:      netlink.LinkSetUp,
+	linkDel:        netlink.LinkDel,
+	addMacvlan:     addMacvlan,
+	configureIface: configureIface,
+	setIfaceUp:     setIfaceUp,
+	execAdd:        ipam.ExecAdd,
+	execRelease:    ipam.ExecRelease,
+	printResult:    types.PrintResult,
+}
+
+// newAddSteps ADD的各个步骤: 创建macvlan, 分配并配置ip(L2只启用网卡), 缓存结果, 输出结果
+func (o *addOps) newAddSteps(req *addRequest) []addStep {
+	args, n, result := req.args, req.conf, req.result
+	steps := []addStep{
+		{name: "macvlan", run: func(undo *util.Undo) error {
+			macvlanInterface, err := o.createMacvlan(n, args.IfName, req.netns, undo)
 			if err != nil {
-				ipam.ExecDel(client, n, args)
+				return err
 			}
-		}()
-
-		// Convert whatever the IPAM result was into the current Result type
-		ipamResult, err := current.NewResultFromResult(r)
+			// Assume L2 interface only
+			result.Interfaces = []*current.Interface{macvlanInterface}
+			return nil
+		}},
+	}
+	isLayer3 := n.IPAM != nil && n.IPAM.Type != ""
+	log.Infof("Cmd add current isLayer3=%t", isLayer3)
+	if isLayer3 {
+		steps = append(steps, addStep{name: "layer3", run: func(undo *util.Undo) error {
+			return o.addLayer3(req, undo)
+		}})
+	} else {
+		// For L2 just change interface status to up
+		steps = append(steps, addStep{name: "link up", run: func(undo *util.Undo) error {
+			return o.setIfaceUp(args.IfName, req.netns)
+		}})
+	}
+	// 保存结果和服务配置, etcd不可用或服务配置已删除时DEL、CHECK使用
+	steps = append(steps, addStep{name: "cache", run: func(undo *util.Undo) error {
+		result.DNS = n.DNS
+		entry, err := cache.NewEntry(args.ContainerID, args.IfName, args.Netns, req.ident, req.rawConf, result)
 		if err != nil {
 			return err
 		}
-
-		if len(ipamResult.IPs) == 0 {
-			return errors.New("IPAM plugin returned missing IP config")
+		if err := req.cache.Put(entry); err != nil {
+			return fmt.Errorf("failed to cache result: %v", err)
 		}
+		undo.Push("cache "+args.ContainerID, func() error {
+			return req.cache.Remove(args.ContainerID, args.IfName)
+		})
+		return nil
+	}})
+	steps = append(steps, addStep{name: "print result", run: func(undo *util.Undo) error {
+		return o.printResult(result, req.cniVersion)
+	}})
+	return steps
+}
 
-		result.IPs = ipamResult.IPs
-		result.Routes = ipamResult.Routes
+// setIfaceUp 启用容器内的网卡
+func setIfaceUp(ifName string, netns ns.NetNS) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		macvlanInterfaceLink, err := netlink.LinkByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find interface name %q: %v", ifName, err)
+		}
 
-		for _, ipc := range result.IPs {
-			// All addresses apply to the container macvlan interface
-			ipc.Interface = current.Int(0)
+		if err := netlink.LinkSetUp(macvlanInterfaceLink); err != nil {
+			return fmt.Errorf("failed to set %q UP: %v", ifName, err)
 		}
 
-		err = netns.Do(func(_ ns.NetNS) error {
-			// 在对应命名空间下, 将ip信息写入到macvlan对应的网卡上
-			if err := ipam.ConfigureIface(args.IfName, result); err != nil {
-				return err
-			}
+		return nil
+	})
+}
 
-			contVeth, err := net.InterfaceByName(args.IfName)
-			if err != nil {
-				return fmt.Errorf("failed to look up %q: %v", args.IfName, err)
-			}
+// addStep ADD的一个步骤, 生效的副作用登记到undo中
+type addStep struct {
+	name string
+	run  func(undo *util.Undo) error
+}
 
-			for _, ipc := range result.IPs {
-				if ipc.Version == "4" {
-					_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
-				}
+// runAddSteps 依次执行ADD的各个步骤, 某一步失败时按相反的顺序撤销已登记的副作用(包括失败的步骤已登记的),
+// 返回该步骤的错误; 撤销失败只记录日志
+func runAddSteps(steps []addStep) error {
+	undo := &util.Undo{}
+	for _, step := range steps {
+		if err := step.run(undo); err != nil {
+			log.Errorf("Cmd add %s failed: %v, undo applied changes", step.name, err)
+			if err := undo.Unwind(); err != nil {
+				log.Errorf("Cmd add %v", err)
 			}
-			return nil
+			return err
+		}
+	}
+	return nil
+}
+
+// addLayer3 分配ip并配置到容器网卡上, 分配的ip和写入的地址登记到undo中
+func (o *addOps) addLayer3(req *addRequest, undo *util.Undo) error {
+	backend, ident, n, args, result := req.backend, req.ident, req.conf, req.args, req.result
+	log.Infof("Cmd add invoke ipam to allocate ip")
+	// run the IPAM plugin and get back the config to apply
+	ipamResult, prior, err := o.execAdd(req.ctx, backend, ident, n, args)
+	if err != nil {
+		return err
+	}
+	reused := true
+	for _, ipc := range ipamResult.IPs {
+		if !etcd.ContainsIP(prior, ipc.Address.IP) {
+			reused = false
+		}
+	}
+	log.Infof("Cmd add allocate ip success, reused: %t", reused)
+
+	// Release ip if err to avoid ip leak; 直接释放, 不走DEL的sticky保留. ctx可能已经到期, 使用独立的ctx回滚.
+	// 重试ADD复用的ip(prior)属于之前成功的ADD, 失败时保留
+	if !reused {
+		undo.Push("ipam", func() error {
+			rollbackCtx, cancel := util.RollbackContext()
+			defer cancel()
+			return o.execRelease(rollbackCtx, backend, ident, n, args, prior)
 		})
+	}
+
+	if len(ipamResult.IPs) == 0 {
+		return errors.New("IPAM plugin returned missing IP config")
+	}
+
+	result.IPs = ipamResult.IPs
+	result.Routes = ipamResult.Routes
+
+	for _, ipc := range result.IPs {
+		// All addresses apply to the container macvlan interface
+		ipc.Interface = current.Int(0)
+	}
+
+	return o.configureIface(args.IfName, req.netns, result, undo)
+}
+
+// configureIface 在容器内把result中的ip配置到网卡上, 写入的地址登记到undo中
+func configureIface(ifName string, netns ns.NetNS, result *current.Result, undo *util.Undo) error {
+	return netns.Do(func(_ ns.NetNS) error {
+		// 复用的网卡不会被删除, 需要撤销写入的地址(地址删除后经过它的路由由内核一并删除).
+		// 网卡上已有的地址来自之前的ADD, 不撤销; 配置可能只完成了一部分, 先登记再配置
+		added, err := missingAddrs(ifName, result.IPs)
 		if err != nil {
 			return err
 		}
-	} else {
-		// For L2 just change interface status to up
-		err = netns.Do(func(_ ns.NetNS) error {
-			macvlanInterfaceLink, err := netlink.LinkByName(args.IfName)
-			if err != nil {
-				return fmt.Errorf("failed to find interface name %q: %v", macvlanInterface.Name, err)
+		if len(added) > 0 {
+			undo.Push("addresses "+ifName, func() error {
+				return netns.Do(func(_ ns.NetNS) error {
+					return unconfigureIface(ifName, added)
+				})
+			})
+		}
+
+		// 在对应命名空间下, 将ip信息写入到macvlan对应的网卡上
+		if err := ipam.ConfigureIface(ifName, result); err != nil {
+			return err
+		}
+
+		contVeth, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to look up %q: %v", ifName, err)
+		}
+
+		for _, ipc := range result.IPs {
+			if ipc.Address.IP.To4() != nil {
+				_ = arping.GratuitousArpOverIface(ipc.Address.IP, *contVeth)
 			}
+		}
+		return nil
+	})
+}
 
-			if err := netlink.LinkSetUp(macvlanInterfaceLink); err != nil {
-				return fmt.Errorf("failed to set %q UP: %v", args.IfName, err)
+// missingAddrs 返回ips中网卡上还没有的地址
+func missingAddrs(ifName string, ips []*current.IPConfig) ([]*current.IPConfig, error) {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lookup %q: %v", ifName, err)
+	}
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %q: %v", ifName, err)
+	}
+	var missing []*current.IPConfig
+	for _, ipc := range ips {
+		found := false
+		for _, addr := range addrs {
+			if addr.IPNet.String() == ipc.Address.String() {
+				found = true
+				break
 			}
+		}
+		if !found {
+			missing = append(missing, ipc)
+		}
+	}
+	return missing, nil
+}
 
+// unconfigureIface 删除网卡上由ADD写入的地址, 网卡或地址已不存在时忽略
+func unconfigureIface(ifName string, ips []*current.IPConfig) error {
+	link, err := netlink.LinkByName(ifName)
+	if err != nil {
+		if _, ok := err.(netlink.LinkNotFoundError); ok {
 			return nil
-		})
-		if err != nil {
-			return err
 		}
+		return err
 	}
-
-	result.DNS = n.DNS
-
-	return types.PrintResult(result, cniVersion)
+	for _, ipc := range ips {
+		addr := &netlink.Addr{IPNet: &ipc.Address}
+		if err := netlink.AddrDel(link, addr); err != nil && err != syscall.EADDRNOTAVAIL {
+			return fmt.Errorf("failed to delete IP addr %v from %q: %v", ipc.Address, ifName, err)
+		}
+	}
+	return nil
 }
 
+// cmdDel etcd不可用或服务配置已删除时, 使用本地缓存的ADD结果清理容器网络,
+// 未能释放的ip保存到本地, 之后的ADD/DEL/GC在etcd恢复后重放, 避免kubelet无限重试DEL
 func cmdDel(args *skel.CmdArgs) error {
-	client, err := getClient(args.StdinData)
+	localConf, err := config.ReadLocalConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	n, _, err := loadConf(client, args.Args)
+	ctx, cancel := localConf.Context()
+	defer cancel()
+
+	ident, err := getIdentity(localConf, args.Args)
 	if err != nil {
 		return err
 	}
 
-	isLayer3 := n.IPAM.Type != ""
+	// 0.4.0及以上DEL会带上ADD的结果, 用于确定需要删除的网卡
+	prevResult, err := parsePrevResult(&localConf.NetConf)
+	if err != nil {
+		return err
+	}
+
+	resultCache := cache.New(localConf.CacheDir())
+	cached, err := resultCache.Get(args.ContainerID, args.IfName)
+	if err != nil {
+		log.Warnf("Cmd del read cached result failed: %v", err)
+	}
+
+	var n *config.NetConf
+	backend, err := store.New(localConf)
+	if err == nil {
+		defer backend.Close()
+		n, _, err = loadConf(ctx, backend, ident.Service)
+	}
+	storeErr := err
+	if storeErr != nil {
+		switch {
+		case cached != nil:
+			log.Warnf("Cmd del load service: %s config failed: %v, use cached config revision: %s", ident.Service, storeErr, cached.Revision)
+			if n, err = parseConf(cached.Config); err != nil {
+				return err
+			}
+		case backend == nil:
+			return storeErr
+		default:
+			// 服务配置已删除或无法解析, 按分配记录释放
+			log.Warnf("Cmd del load service: %s config failed: %v, release by allocation records", ident.Service, storeErr)
+		}
+	}
+
+	// 没有服务配置时无法判断是否分配过ip, 按分配记录释放, 没有记录时什么都不做
+	isLayer3 := n == nil || (n.IPAM != nil && n.IPAM.Type != "")
 	log.Infof("Cmd del current isLayer3=%t", isLayer3)
 
+	queued := false
 	if isLayer3 {
 		log.Infof("Cmd del invoke ipam to del allocated ip")
-		err = ipam.ExecDel(client, n, args)
+		err = storeErr
+		if backend != nil {
+			err = ipam.ExecDel(ctx, backend, ident, n, args)
+		}
 		if err != nil {
-			return err
+			if cached == nil {
+				return err
+			}
+			if qerr := resultCache.Queue(cached); qerr != nil {
+				return fmt.Errorf("release ip failed: %v, queue release failed: %v", err, qerr)
+			}
+			queued = true
+			log.Warnf("Cmd del release container: %s ip failed: %v, queued for replay", args.ContainerID, err)
+		} else {
+			log.Infof("(1) delete container ip success")
+			replayCtx, replayCancel := util.ReplayContext(ctx)
+			replayReleases(replayCtx, backend, resultCache)
+			replayCancel()
 		}
-		log.Infof("(1) delete container ip success")
 	}
 
-	if args.Netns == "" {
-		return nil
-	}
+	if args.Netns != "" {
+		// 没有prevResult时使用缓存的ADD结果确定需要删除的网卡
+		if prevResult == nil && cached != nil {
+			if prevResult, err = cached.GetResult(); err != nil {
+				log.Warnf("Cmd del %v", err)
+			}
+		}
 
-	// There is a netns so try to clean up. Delete can be called multiple times
-	// so don't return an error if the device is already removed.
-	err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
-		if err := ip.DelLinkByName(args.IfName); err != nil {
-			if err != ip.ErrLinkNotFound {
-				return err
+		// There is a netns so try to clean up. Delete can be called multiple times
+		// so don't return an error if the device is already removed.
+		ifNames := containerIfNames(prevResult, args)
+		err = ns.WithNetNSPath(args.Netns, func(_ ns.NetNS) error {
+			for _, ifName := range ifNames {
+				if err := ip.DelLinkByName(ifName); err != nil {
+					if err != ip.ErrLinkNotFound {
+						return err
+					}
+				}
 			}
+			return nil
+		})
+		if err != nil {
+			return err
 		}
-		return nil
-	})
-	log.Infof("(2) delete container netns: %s success", args.Netns)
+		log.Infof("(2) delete container netns: %s interfaces: %v success", args.Netns, ifNames)
+	}
 
-	return err
+	if !queued {
+		if err := resultCache.Remove(args.ContainerID, args.IfName); err != nil {
+			log.Warnf("Cmd del remove cached result failed: %v", err)
+		}
+	}
+	return nil
 }
 
+// containerIfNames DEL需要删除的容器网卡: prevResult中位于该netns的网卡, 没有prevResult时为CNI_IFNAME
+func containerIfNames(prevResult *current.Result, args *skel.CmdArgs) []string {
+	if prevResult == nil {
+		return []string{args.IfName}
+	}
+	var names []string
+	for _, intf := range prevResult.Interfaces {
+		if intf.Sandbox != "" && intf.Sandbox == args.Netns && intf.Name != "" {
+			names = append(names, intf.Name)
+		}
+	}
+	if len(names) == 0 {
+		names = append(names, args.IfName)
+	}
+	return names
+}
+
+// cmdCheck etcd不可用或服务配置已删除时, 使用本地缓存的服务配置, 缓存中有ADD结果即认为ip已分配
 func cmdCheck(args *skel.CmdArgs) error {
-	client, err := getClient(args.StdinData)
+	localConf, err := config.ReadLocalConf(args.StdinData)
 	if err != nil {
 		return err
 	}
 
-	n, _, err := loadConf(client, args.Args)
+	ctx, cancel := localConf.Context()
+	defer cancel()
+
+	ident, err := getIdentity(localConf, args.Args)
 	if err != nil {
 		return err
 	}
-	isLayer3 := n.IPAM.Type != ""
+
+	cached, err := cache.New(localConf.CacheDir()).Get(args.ContainerID, args.IfName)
+	if err != nil {
+		log.Warnf("Cmd check read cached result failed: %v", err)
+	}
+
+	var n *config.NetConf
+	var rawConf []byte
+	backend, err := store.New(localConf)
+	if err == nil {
+		defer backend.Close()
+		n, rawConf, err = loadConf(ctx, backend, ident.Service)
+	}
+	useCache := false
+	if err != nil {
+		if cached == nil {
+			return err
+		}
+		log.Warnf("Cmd check load service: %s config failed: %v, use cached config revision: %s", ident.Service, err, cached.Revision)
+		if n, err = parseConf(cached.Config); err != nil {
+			return err
+		}
+		useCache = true
+	} else if cached != nil && cached.Revision != cache.Revision(rawConf) {
+		log.Infof("Cmd check service: %s config changed since add, revision: %s -> %s", ident.Service, cached.Revision, cache.Revision(rawConf))
+	}
+	isLayer3 := n.IPAM != nil && n.IPAM.Type != ""
 
 	netns, err := ns.GetNS(args.Netns)
 	if err != nil {
@@ -425,27 +904,22 @@ func cmdCheck(args *skel.CmdArgs) error {
 	}
 	defer netns.Close()
 
-	if isLayer3 {
+	if isLayer3 && !useCache {
 		// run the IPAM plugin and get back the config to apply
-		err = ipam.ExecCheck(client, n, args)
+		err = ipam.ExecCheck(ctx, backend, ident, n, args)
 		if err != nil {
 			return err
 		}
 	}
 
-	// Parse previous result.
-	if n.NetConf.RawPrevResult == nil {
-		return fmt.Errorf("Required prevResult missing")
-	}
-
-	if err := version.ParsePrevResult(&n.NetConf); err != nil {
-		return err
-	}
-
-	result, err := current.NewResultFromResult(n.PrevResult)
+	// Parse previous result. prevResult由运行时放在本地配置中传入
+	result, err := parsePrevResult(&localConf.NetConf)
 	if err != nil {
 		return err
 	}
+	if result == nil {
+		return fmt.Errorf("Required prevResult missing")
+	}
 
 	var contMap current.Interface
 	// Find interfaces for names whe know, macvlan device name inside container
@@ -515,9 +989,20 @@ func validateCniContainerInterface(intf current.Interface, parentIndex int, mode
 		return fmt.Errorf("Error: Container interface %s not of type macvlan", link.Attrs().Name)
 	}
 
-	mode, _ := modeFromString()
+	mode, err := modeFromString(modeExpected)
+	if err != nil {
+		return err
+	}
 	if macv.Mode != mode {
-		return fmt.Errorf("Container macvlan mode %v does not match expected value: %v", macv.Mode, mode)
+		currString, err := modeToString(macv.Mode)
+		if err != nil {
+			return err
+		}
+		confString, err := modeToString(mode)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("Container macvlan mode %s does not match expected value: %s", currString, confString)
 	}
 
 	if intf.Mac != "" {
@@ -527,3 +1012,19 @@ func validateCniContainerInterface(intf current.Interface, parentIndex int, mode
 	}
 	return nil
 }
+
+// cmdStatus CNI 1.1 STATUS: 存储后端不可用时无法分配ip, 返回插件不可用
+func cmdStatus(args *skel.CmdArgs) error {
+	backend, localConf, err := getBackend(args.StdinData)
+	if err != nil {
+		return types.NewError(errPluginNotAvailable, "failed to connect store", err.Error())
+	}
+	defer backend.Close()
+
+	ctx, cancel := localConf.Context()
+	defer cancel()
+	if err := backend.Ping(ctx); err != nil {
+		return types.NewError(errPluginNotAvailable, "store is not available", err.Error())
+	}
+	return nil
+}
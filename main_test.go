@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+
+	"neutron/pkg/cache"
+	"neutron/pkg/config"
+	"neutron/pkg/log"
+	"neutron/pkg/store"
+	"neutron/pkg/util"
+)
+
+func TestMain(m *testing.M) {
+	log.InitCliLogger()
+	os.Exit(m.Run())
+}
+
+// fakeAdd 替换addOps中访问内核网卡和ipam的操作: 记录执行的撤销操作, failAt指定的操作返回错误
+type fakeAdd struct {
+	links  map[string]netlink.Link
+	reused bool // ipam复用了之前ADD分配的ip
+	failAt string
+	undone []string
+}
+
+func (f *fakeAdd) fail(op string) error {
+	if op == f.failAt {
+		return fmt.Errorf("%s: injected", op)
+	}
+	return nil
+}
+
+func (f *fakeAdd) record(name string) func() error {
+	return func() error {
+		f.undone = append(f.undone, name)
+		return nil
+	}
+}
+
+func (f *fakeAdd) ops() *addOps {
+	return &addOps{
+		linkByName: func(name string) (netlink.Link, error) {
+			if link, ok := f.links[name]; ok {
+				return link, nil
+			}
+			return nil, netlink.LinkNotFoundError{}
+		},
+		linkAdd: func(link netlink.Link) error {
+			if err := f.fail("linkAdd"); err != nil {
+				return err
+			}
+			f.links[link.Attrs().Name] = link
+			return nil
+		},
+		linkSetUp: func(link netlink.Link) error {
+			return f.fail("linkSetUp")
+		},
+		linkDel: func(link netlink.Link) error {
+			f.undone = append(f.undone, "vlan")
+			delete(f.links, link.Attrs().Name)
+			return nil
+		},
+		addMacvlan: func(conf *config.NetConf, mode netlink.MacvlanMode, m netlink.Link, ifName string, netns ns.NetNS, undo *util.Undo) (*current.Interface, error) {
+			if err := f.fail("addMacvlan"); err != nil {
+				return nil, err
+			}
+			undo.Push("macvlan", f.record("macvlan"))
+			return &current.Interface{Name: ifName}, nil
+		},
+		configureIface: func(ifName string, netns ns.NetNS, result *current.Result, undo *util.Undo) error {
+			undo.Push("addresses", f.record("addresses"))
+			return f.fail("configureIface")
+		},
+		setIfaceUp: func(ifName string, netns ns.NetNS) error {
+			return f.fail("setIfaceUp")
+		},
+		execAdd: func(ctx context.Context, backend store.Backend, ident *util.Identity, conf *config.NetConf, args *skel.CmdArgs) (*current.Result, []net.IP, error) {
+			if err := f.fail("execAdd"); err != nil {
+				return nil, nil, err
+			}
+			ip, ipNet, _ := net.ParseCIDR("10.0.0.2/24")
+			ipNet.IP = ip
+			var prior []net.IP
+			if f.reused {
+				prior = []net.IP{ip}
+			}
+			return &current.Result{IPs: []*current.IPConfig{{Address: *ipNet}}}, prior, nil
+		},
+		execRelease: func(ctx context.Context, backend store.Backend, ident *util.Identity, conf *config.NetConf, args *skel.CmdArgs, prior []net.IP) error {
+			f.undone = append(f.undone, "ipam")
+			return nil
+		},
+		printResult: func(result types.Result, version string) error {
+			return f.fail("printResult")
+		},
+	}
+}
+
+// TestAddStepsUndo 在cmdAdd实际的各个步骤中注入失败, 检查登记并按相反的顺序执行的撤销操作:
+// vlan只在本次创建时撤销, 复用之前ADD的ip时不释放
+func TestAddStepsUndo(t *testing.T) {
+	tests := []struct {
+		name       string
+		vlanExists bool
+		reused     bool
+		layer2     bool
+		failAt     string
+		want       []string
+		wantCached bool
+	}{
+		{name: "success", failAt: "", wantCached: true},
+		{name: "create vlan fails", failAt: "linkAdd"},
+		{name: "vlan up fails", failAt: "linkSetUp", want: []string{"vlan"}},
+		{name: "macvlan fails", failAt: "addMacvlan", want: []string{"vlan"}},
+		{name: "ipam fails", failAt: "execAdd", want: []string{"macvlan", "vlan"}},
+		{name: "configure fails", failAt: "configureIface", want: []string{"addresses", "ipam", "macvlan", "vlan"}},
+		{name: "print fails", failAt: "printResult", want: []string{"addresses", "ipam", "macvlan", "vlan"}},
+		{name: "existing vlan", vlanExists: true, failAt: "printResult", want: []string{"addresses", "ipam", "macvlan"}},
+		{name: "reused ip", reused: true, failAt: "printResult", want: []string{"addresses", "macvlan", "vlan"}},
+		{name: "layer2 link up fails", layer2: true, failAt: "setIfaceUp", want: []string{"macvlan", "vlan"}},
+		{name: "layer2 print fails", layer2: true, failAt: "printResult", want: []string{"macvlan", "vlan"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeAdd{
+				links: map[string]netlink.Link{
+					"bond0": &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "bond0", Index: 2, OperState: netlink.OperUp}},
+				},
+				reused: tt.reused,
+				failAt: tt.failAt,
+			}
+			if tt.vlanExists {
+				f.links["bond0.5000"] = &netlink.Vlan{LinkAttrs: netlink.LinkAttrs{Name: "bond0.5000", Index: 3}, VlanId: 5000}
+			}
+			n := &config.NetConf{Master: "bond0.5000"}
+			if !tt.layer2 {
+				n.IPAM = &config.IPAMConfig{Type: "neutron"}
+			}
+			resultCache := cache.New(t.TempDir())
+			req := &addRequest{
+				ctx:     context.Background(),
+				ident:   &util.Identity{Service: "svc"},
+				conf:    n,
+				rawConf: []byte(`{}`),
+				args:    &skel.CmdArgs{ContainerID: "a", IfName: "eth0", Netns: "/var/run/netns/a"},
+				cache:   resultCache,
+				result:  &current.Result{},
+			}
+
+			err := runAddSteps(f.ops().newAddSteps(req))
+			if (err != nil) != (tt.failAt != "") {
+				t.Fatalf("got error %v, want failure at %q", err, tt.failAt)
+			}
+			if !reflect.DeepEqual(f.undone, tt.want) {
+				t.Errorf("undone %v, want %v", f.undone, tt.want)
+			}
+			entry, err := resultCache.Get("a", "eth0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached := entry != nil; cached != tt.wantCached {
+				t.Errorf("cached %t, want %t", cached, tt.wantCached)
+			}
+		})
+	}
+}
+
+// TestRunAddStepsUndoFailure 撤销失败时继续撤销之前的步骤, 返回失败步骤的错误
+func TestRunAddStepsUndoFailure(t *testing.T) {
+	var undone []string
+	stepErr := errors.New("injected")
+	steps := []addStep{
+		{name: "macvlan", run: func(undo *util.Undo) error {
+			undo.Push("macvlan", func() error {
+				undone = append(undone, "macvlan")
+				return nil
+			})
+			return nil
+		}},
+		{name: "layer3", run: func(undo *util.Undo) error {
+			undo.Push("ipam", func() error {
+				undone = append(undone, "ipam")
+				return errors.New("etcd unavailable")
+			})
+			return nil
+		}},
+		{name: "cache", run: func(undo *util.Undo) error {
+			return stepErr
+		}},
+		{name: "print result", run: func(undo *util.Undo) error {
+			t.Error("step after the failed one ran")
+			return nil
+		}},
+	}
+	if err := runAddSteps(steps); err != stepErr {
+		t.Fatalf("got error %v, want the failed step's error", err)
+	}
+	if want := []string{"ipam", "macvlan"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("undone %v, want %v", undone, want)
+	}
+}
@@ -0,0 +1,237 @@
+// copyright @ 2020 ops inc.
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+
+	"neutron/pkg/log"
+	"neutron/pkg/util"
+)
+
+// DefaultDir 本地结果缓存的默认目录
+const DefaultDir = "/var/lib/cni/neutron/cache"
+
+// Cache 本地磁盘上的ADD结果缓存, etcd不可用或服务配置已删除时DEL、CHECK使用缓存完成:
+//
+//	<dir>/results/<containerID>-<ifName>  成功的ADD的结果及使用的服务配置
+//	<dir>/pending/<containerID>-<ifName>  etcd不可用时DEL未能释放的ip, 等待重放
+type Cache struct {
+	resultsDir string
+	pendingDir string
+}
+
+// Entry 一次成功的ADD
+type Entry struct {
+	ContainerID  string          `json:"containerId"`
+	IfName       string          `json:"ifName"`
+	Netns        string          `json:"netns"`
+	Service      string          `json:"service"`
+	Stage        string          `json:"stage,omitempty"`
+	PodName      string          `json:"podName,omitempty"`
+	PodNamespace string          `json:"podNamespace,omitempty"`
+	Config       json.RawMessage `json:"config"`   // ADD时使用的服务配置
+	Revision     string          `json:"revision"` // 服务配置的版本, 见Revision
+	Result       json.RawMessage `json:"result"`   // ADD的结果
+	Created      time.Time       `json:"created"`
+}
+
+// New dir为空时使用DefaultDir
+func New(dir string) *Cache {
+	if dir == "" {
+		dir = DefaultDir
+	}
+	return &Cache{
+		resultsDir: filepath.Join(dir, "results"),
+		pendingDir: filepath.Join(dir, "pending"),
+	}
+}
+
+// Revision 服务配置的版本: 内容的sha256, 各存储后端通用
+func Revision(conf []byte) string {
+	sum := sha256.Sum256(conf)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewEntry 根据ADD使用的服务配置和结果生成缓存记录
+func NewEntry(containerID, ifName, netns string, ident *util.Identity, conf []byte, result *current.Result) (*Entry, error) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{
+		ContainerID:  containerID,
+		IfName:       ifName,
+		Netns:        netns,
+		Service:      ident.Service,
+		Stage:        ident.Stage,
+		PodName:      ident.PodName,
+		PodNamespace: ident.PodNamespace,
+		Config:       conf,
+		Revision:     Revision(conf),
+		Result:       data,
+		Created:      time.Now(),
+	}, nil
+}
+
+// Identity ADD时解析的服务名、发布阶段
+func (e *Entry) Identity() *util.Identity {
+	return &util.Identity{
+		Service:      e.Service,
+		Stage:        e.Stage,
+		PodName:      e.PodName,
+		PodNamespace: e.PodNamespace,
+	}
+}
+
+// GetResult ADD的结果
+func (e *Entry) GetResult() (*current.Result, error) {
+	var result current.Result
+	if err := json.Unmarshal(e.Result, &result); err != nil {
+		return nil, fmt.Errorf("invalid cached result of container %s: %v", e.ContainerID, err)
+	}
+	return &result, nil
+}
+
+func entryName(containerID, ifName string) string {
+	return containerID + "-" + ifName
+}
+
+// Put 保存ADD的结果, 重试ADD时覆盖
+func (c *Cache) Put(e *Entry) error {
+	return writeEntry(c.resultsDir, e)
+}
+
+// Get 获取容器的ADD结果, 没有缓存时返回nil
+func (c *Cache) Get(containerID, ifName string) (*Entry, error) {
+	e, err := readEntry(filepath.Join(c.resultsDir, entryName(containerID, ifName)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return e, err
+}
+
+// List 所有ADD结果, 无法解析的文件记录日志后跳过
+func (c *Cache) List() ([]*Entry, error) {
+	return listEntries(c.resultsDir)
+}
+
+// Remove 删除容器的ADD结果, 不存在时忽略
+func (c *Cache) Remove(containerID, ifName string) error {
+	return removeEntry(c.resultsDir, containerID, ifName)
+}
+
+// Queue DEL释放ip失败时, 将记录移到pending中等待重放
+func (c *Cache) Queue(e *Entry) error {
+	if err := writeEntry(c.pendingDir, e); err != nil {
+		return err
+	}
+	return c.Remove(e.ContainerID, e.IfName)
+}
+
+// Pending 等待重放的释放
+func (c *Cache) Pending() ([]*Entry, error) {
+	return listEntries(c.pendingDir)
+}
+
+// Done 重放成功后删除pending中的记录
+func (c *Cache) Done(e *Entry) error {
+	return removeEntry(c.pendingDir, e.ContainerID, e.IfName)
+}
+
+// writeEntry 先写临时文件再rename, 并发的读不会读到写了一半的文件;
+// rename之前fsync文件、之后fsync目录, 节点掉电后不会留下空文件或丢失记录
+func writeEntry(dir string, e *Entry) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, entryName(e.ContainerID, e.IfName))); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir fsync目录, 保证rename已经落盘
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func readEntry(path string) (*Entry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e Entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid cache file %s: %v", path, err)
+	}
+	return &e, nil
+}
+
+func listEntries(dir string) ([]*Entry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for _, file := range files {
+		if file.IsDir() || file.Name()[0] == '.' {
+			continue
+		}
+		e, err := readEntry(filepath.Join(dir, file.Name()))
+		if err != nil {
+			log.Warnf("Skip cache entry %s: %v", file.Name(), err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func removeEntry(dir, containerID, ifName string) error {
+	err := os.Remove(filepath.Join(dir, entryName(containerID, ifName)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"neutron/pkg/log"
+)
+
+func TestMain(m *testing.M) {
+	log.InitCliLogger()
+	os.Exit(m.Run())
+}
+
+func TestListSkipsInvalidEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := New(dir)
+	if err := c.Put(&Entry{ContainerID: "a", IfName: "eth0", Service: "pay"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "results", "b-eth0"), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := c.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].ContainerID != "a" {
+		t.Errorf("got %+v, want only the valid entry", entries)
+	}
+	// 临时文件已经rename, 不残留
+	files, _ := ioutil.ReadDir(filepath.Join(dir, "results"))
+	if len(files) != 2 {
+		t.Errorf("got %d files in results, want 2", len(files))
+	}
+}
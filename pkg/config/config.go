@@ -1,29 +1,68 @@
 package config
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
+	"time"
 
 	"github.com/containernetworking/cni/pkg/types"
-	types020 "github.com/containernetworking/cni/pkg/types/020"
+	"github.com/containernetworking/cni/pkg/version"
 
 	"neutron/pkg/etcd"
+	"neutron/pkg/util"
 )
 
 // LocalConf 基于types.NetConf扩展 添加etcd配置
 type LocalConf struct {
 	types.NetConf
-	Etcd *etcd.EtcdConf `json:"etcd"`
+	Store         string             `json:"store"`    // 存储后端: etcd(默认)、disk、memory
+	DataDir       string             `json:"dataDir"`  // disk存储后端的数据目录
+	Identity      *util.IdentityConf `json:"identity"` // 服务名、发布阶段的提取方式
+	Etcd          *etcd.EtcdConf     `json:"etcd"`
+	Timeout       int                `json:"timeout"` // 单次ADD/DEL/CHECK访问存储的总时间(秒), 包括等待锁
+	IPAM          *IPAMConfig        `json:"ipam"`    // 本地ipam配置, 只使用dataDir(本地结果缓存目录)
+	RuntimeConfig struct {           // pod labels/annotations, 由运行时或multus传入
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"runtimeConfig,omitempty"`
+}
+
+// DefaultTimeout 单次调用访问存储的默认总时间
+const DefaultTimeout = 60 * time.Second
+
+// Context 创建单次调用的ctx, 超过Timeout后所有存储操作返回失败, 调用方回滚后退出,
+// 而不是一直阻塞到被kubelet杀掉
+func (c *LocalConf) Context() (context.Context, context.CancelFunc) {
+	timeout := DefaultTimeout
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout) * time.Second
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// CacheDir 本地结果缓存目录, 未配置时返回空, 由cache使用默认目录.
+// etcd不可用时DEL也需要找到缓存, 只能配置在本地配置中, 服务配置中的ipam.dataDir不生效
+func (c *LocalConf) CacheDir() string {
+	if c.IPAM == nil {
+		return ""
+	}
+	return c.IPAM.DataDir
 }
 
 // ReadLocalConf 解析macvlan插件本地配置: /etc/cni/net.d/10-maclannet.conf
 func ReadLocalConf(std []byte) (*LocalConf, error) {
 	/*
 		{
-			"cniVersion":"0.3.1",
+			"cniVersion":"1.0.0",
 			"name": "neutron",
 			"type": "neutron",
+			"store": "etcd",
+			"identity": {
+				"source": "regex",
+				"regex": "^(?P<service>.+?)-\\d+(?:-(?P<stage>[^-]+))?"
+			},
 			"etcd": {
 				"urls": "https://127.0.0.1:2379",
 				"cafile": "/etc/etcd/ssl/etcd-ca.pem",
@@ -62,12 +101,30 @@ type IPAMConfig struct {
 	DataDir    string         `json:"dataDir"`
 	ResolvConf string         `json:"resolvConf"`
 	Ranges     []RangeSet     `json:"ranges"`
-	IPArgs     []net.IP       `json:"-"` // Requested IPs from CNI_ARGS and args
+	Sticky     *StickyConf    `json:"sticky,omitempty"`    // 粘性ip, 未配置时DEL直接释放
+	Cooldown   int            `json:"cooldown,omitempty"`  // 释放的ip的冷却时间(秒), 冷却期间不会被自动分配
+	Strategy   string         `json:"strategy,omitempty"`  // 分配策略: roundRobin(默认)、lowestFree、random、hostAffinity
+	BlockSize  int            `json:"blockSize,omitempty"` // 按块分配时每个块的掩码长度(如28), 0表示不按块分配
+	IPArgs     []net.IP       `json:"-"`                   // Requested IPs from CNI_ARGS and args
 }
 
-type IPAMEnvArgs struct {
-	types.CommonArgs
-	IP net.IP `json:"ip,omitempty"`
+// 分配策略
+const (
+	StrategyRoundRobin   = "roundRobin"   // 从上次分配的ip之后开始, 均匀使用整个range
+	StrategyLowestFree   = "lowestFree"   // 优先分配最小的空闲ip
+	StrategyRandom       = "random"       // 从随机位置开始分配
+	StrategyHostAffinity = "hostAffinity" // 优先分配之前在当前主机上使用过的ip
+)
+
+// Strategies 支持的分配策略
+var Strategies = []string{StrategyRoundRobin, StrategyLowestFree, StrategyRandom, StrategyHostAffinity}
+
+// CooldownDuration 释放的ip的冷却时间, 0表示直接释放
+func (c *IPAMConfig) CooldownDuration() time.Duration {
+	if c.Cooldown <= 0 {
+		return 0
+	}
+	return time.Duration(c.Cooldown) * time.Second
 }
 
 type IPAMArgs struct {
@@ -77,11 +134,20 @@ type IPAMArgs struct {
 type RangeSet []Range
 
 type Range struct {
-	RangeStart net.IP      `json:"rangeStart,omitempty"` // The first ip, inclusive
-	RangeEnd   net.IP      `json:"rangeEnd,omitempty"`   // The last ip, inclusive
-	Subnet     types.IPNet `json:"subnet"`               // cidr
-	Gateway    net.IP      `json:"gateway,omitempty"`    // giteway
-	Sandbox    []net.IP    `json:"sandbox,omitempty"`    // [ip]
+	RangeStart net.IP                `json:"rangeStart,omitempty"` // The first ip, inclusive
+	RangeEnd   net.IP                `json:"rangeEnd,omitempty"`   // The last ip, inclusive
+	Subnet     types.IPNet           `json:"subnet"`               // cidr
+	Gateway    net.IP                `json:"gateway,omitempty"`    // giteway
+	Sandbox    []net.IP              `json:"sandbox,omitempty"`    // [ip] 兼容旧配置, 等同于stages.sandbox.ips
+	Stages     map[string]*StagePool `json:"stages,omitempty"`     // 发布阶段 -> ip池
+}
+
+// StagePool 发布阶段(sandbox、small、online等)专用的ip池, 由ip列表和/或子range组成.
+// 阶段有对应的ip池时只从该池分配; 没有时从default池分配, 未配置default池则从不属于任何池的ip中分配
+type StagePool struct {
+	IPs        []net.IP `json:"ips,omitempty"`
+	RangeStart net.IP   `json:"rangeStart,omitempty"` // inclusive
+	RangeEnd   net.IP   `json:"rangeEnd,omitempty"`   // inclusive
 }
 
 // ReadTotalConf 将etcd中的完整配置转出对应结构
@@ -101,7 +167,10 @@ func ReadTotalConf(std []byte) (*NetConf, error) {
 				  "rangeEnd": "172.132.28.160",
 				  "subnet": "172.132.28.0/24",
 				  "gateway": "172.132.28.1",
-				  "sandbox": ["172.132.28.150"]
+				  "stages": {
+					"sandbox": {"ips": ["172.132.28.150"]},
+					"small": {"rangeStart": "172.132.28.151", "rangeEnd": "172.132.28.153"}
+				  }
 				}
 			  ]
 			],
@@ -115,29 +184,21 @@ func ReadTotalConf(std []byte) (*NetConf, error) {
 	*/
 	var conf NetConf
 	if err := json.Unmarshal(std, &conf); err != nil {
-		return nil, err
+		return nil, fmt.Errorf("invalid service config json: %v", err)
 	}
 	return &conf, nil
 }
 
 // LoadIPAMConfig 根据给定网络名创建网络配置NetworkConfig
 // 功能: ipam.Ranges地址段校验、ipam.Ranges网段重叠校验
-func LoadIPAMConfig(n *NetConf, envArgs string) (*IPAMConfig, string, error) {
+func LoadIPAMConfig(n *NetConf, args *util.CNIArgs) (*IPAMConfig, string, error) {
 	if n.IPAM == nil {
 		return nil, "", fmt.Errorf("IPAM config missing 'ipam' key")
 	}
 
 	// Parse custom IP from both env args *and* the top-level args config
-	if envArgs != "" {
-		e := IPAMEnvArgs{}
-		err := types.LoadArgs(envArgs, &e)
-		if err != nil {
-			return nil, "", err
-		}
-
-		if e.IP != nil {
-			n.IPAM.IPArgs = []net.IP{e.IP}
-		}
+	if args != nil && args.IP != nil {
+		n.IPAM.IPArgs = []net.IP{args.IP}
 	}
 
 	if n.Args != nil && n.Args.A != nil && len(n.Args.A.IPs) != 0 {
@@ -183,10 +244,8 @@ func LoadIPAMConfig(n *NetConf, envArgs string) (*IPAMConfig, string, error) {
 
 	// CNI spec 0.2.0 and below supported only one v4 and v6 address
 	if numV4 > 1 || numV6 > 1 {
-		for _, v := range types020.SupportedVersions {
-			if n.CNIVersion == v {
-				return nil, "", fmt.Errorf("CNI version %v does not support more than 1 address per family", n.CNIVersion)
-			}
+		if ok, _ := version.GreaterThanOrEqualTo(n.CNIVersion, "0.3.0"); !ok {
+			return nil, "", fmt.Errorf("CNI version %v does not support more than 1 address per family", n.CNIVersion)
 		}
 	}
 
@@ -22,6 +22,11 @@ import (
 	"github.com/containernetworking/plugins/pkg/ip"
 )
 
+const (
+	StageSandbox = "sandbox"
+	StageDefault = "default"
+)
+
 // Canonicalize takes a given range and ensures that all information is consistent,
 // filling out Start, End, and Gateway with sane values if missing
 func (r *Range) Canonicalize() error {
@@ -84,9 +89,110 @@ func (r *Range) Canonicalize() error {
 		r.RangeEnd = lastIP(r.Subnet)
 	}
 
+	return r.canonicalizeStages()
+}
+
+// canonicalizeStages 将旧配置的sandbox合并到stages, 并规范化每个ip池.
+// 生成新的map, 不修改原配置中的ip池
+func (r *Range) canonicalizeStages() error {
+	if len(r.Stages) == 0 && len(r.Sandbox) == 0 {
+		return nil
+	}
+
+	stages := make(map[string]*StagePool, len(r.Stages)+1)
+	for name, pool := range r.Stages {
+		if pool == nil {
+			return fmt.Errorf("stage %q has empty pool", name)
+		}
+		p := &StagePool{
+			IPs:        append([]net.IP{}, pool.IPs...),
+			RangeStart: pool.RangeStart,
+			RangeEnd:   pool.RangeEnd,
+		}
+		stages[name] = p
+	}
+	if len(r.Sandbox) > 0 {
+		p, ok := stages[StageSandbox]
+		if !ok {
+			p = &StagePool{}
+			stages[StageSandbox] = p
+		}
+		p.IPs = append(p.IPs, r.Sandbox...)
+		r.Sandbox = nil
+	}
+
+	for name, p := range stages {
+		for i := range p.IPs {
+			if err := CanonicalizeIP(&p.IPs[i]); err != nil {
+				return fmt.Errorf("stage %q: %v", name, err)
+			}
+		}
+		if (p.RangeStart == nil) != (p.RangeEnd == nil) {
+			return fmt.Errorf("stage %q must set both rangeStart and rangeEnd", name)
+		}
+		if p.RangeStart != nil {
+			if err := CanonicalizeIP(&p.RangeStart); err != nil {
+				return fmt.Errorf("stage %q: %v", name, err)
+			}
+			if err := CanonicalizeIP(&p.RangeEnd); err != nil {
+				return fmt.Errorf("stage %q: %v", name, err)
+			}
+		}
+	}
+	r.Stages = stages
 	return nil
 }
 
+// Contains 判断ip是否属于该ip池
+func (p *StagePool) Contains(addr net.IP) bool {
+	for _, v := range p.IPs {
+		if v.Equal(addr) {
+			return true
+		}
+	}
+	if p.RangeStart != nil && p.RangeEnd != nil {
+		if len(addr) == len(p.RangeStart) && ip.Cmp(addr, p.RangeStart) >= 0 && ip.Cmp(addr, p.RangeEnd) <= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Overlaps 判断两个ip池是否有重叠
+func (p *StagePool) Overlaps(p1 *StagePool) bool {
+	for _, v := range p.IPs {
+		if p1.Contains(v) {
+			return true
+		}
+	}
+	for _, v := range p1.IPs {
+		if p.Contains(v) {
+			return true
+		}
+	}
+	if p.RangeStart != nil && p1.RangeStart != nil && len(p.RangeStart) == len(p1.RangeStart) {
+		return ip.Cmp(p.RangeStart, p1.RangeEnd) <= 0 && ip.Cmp(p1.RangeStart, p.RangeEnd) <= 0
+	}
+	return false
+}
+
+// MatchStage 判断ip是否可以分配给指定的发布阶段
+func (r *Range) MatchStage(stage string, addr net.IP) bool {
+	if pool, ok := r.Stages[stage]; ok {
+		return pool.Contains(addr)
+	}
+	if pool, ok := r.Stages[StageDefault]; ok {
+		return pool.Contains(addr)
+	}
+	// 没有对应的ip池, 不能占用其它阶段的ip
+	for _, pool := range r.Stages {
+		if pool.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
 // IsValidIP checks if a given ip is a valid, allocatable address in a given Range
 func (r *Range) Contains(addr net.IP) bool {
 	if err := CanonicalizeIP(&addr); err != nil {
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func newRange(t *testing.T, subnet string, stages map[string]*StagePool, sandbox ...string) *Range {
+	t.Helper()
+	_, n, err := net.ParseCIDR(subnet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Range{Subnet: types.IPNet(*n), Stages: stages}
+	for _, addr := range sandbox {
+		r.Sandbox = append(r.Sandbox, net.ParseIP(addr))
+	}
+	if err := r.Canonicalize(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestMatchStage(t *testing.T) {
+	r := newRange(t, "10.0.0.0/24", map[string]*StagePool{
+		"canary": {RangeStart: net.ParseIP("10.0.0.10"), RangeEnd: net.ParseIP("10.0.0.19")},
+	}, "10.0.0.5")
+
+	tests := []struct {
+		stage string
+		ip    string
+		want  bool
+	}{
+		{StageSandbox, "10.0.0.5", true},  // 旧配置的sandbox合并为sandbox阶段
+		{StageSandbox, "10.0.0.6", false}, // sandbox只能使用自己的池
+		{"canary", "10.0.0.15", true},     // 按范围配置的池
+		{"canary", "10.0.0.5", false},     // 不能占用其他阶段的ip
+		{"", "10.0.0.100", true},          // 没有对应的池, 使用不属于任何池的ip
+		{"", "10.0.0.15", false},          // 不能占用canary的ip
+		{"unknown", "10.0.0.5", false},    // 未配置的阶段同样不能占用sandbox的ip
+		{"unknown", "10.0.0.100", true},
+	}
+	for _, tt := range tests {
+		if got := r.MatchStage(tt.stage, net.ParseIP(tt.ip).To4()); got != tt.want {
+			t.Errorf("MatchStage(%q, %s) = %t, want %t", tt.stage, tt.ip, got, tt.want)
+		}
+	}
+
+	// 配置了default池时, 没有自己池的阶段只能使用default池
+	d := newRange(t, "10.0.0.0/24", map[string]*StagePool{
+		StageDefault: {IPs: []net.IP{net.ParseIP("10.0.0.50")}},
+	})
+	if !d.MatchStage("", net.ParseIP("10.0.0.50").To4()) || d.MatchStage("", net.ParseIP("10.0.0.51").To4()) {
+		t.Errorf("stage without a pool does not use the default pool")
+	}
+}
+
+func TestCanonicalizeStagesMergesSandbox(t *testing.T) {
+	orig := map[string]*StagePool{StageSandbox: {IPs: []net.IP{net.ParseIP("10.0.0.5")}}}
+	r := newRange(t, "10.0.0.0/24", orig, "10.0.0.6")
+	if got := len(r.Stages[StageSandbox].IPs); got != 2 {
+		t.Errorf("sandbox pool has %d ips, want 2", got)
+	}
+	if r.Sandbox != nil {
+		t.Errorf("legacy sandbox not cleared: %v", r.Sandbox)
+	}
+	// 不修改原配置中的ip池
+	if got := len(orig[StageSandbox].IPs); got != 1 {
+		t.Errorf("original pool modified: %d ips", got)
+	}
+}
+
+func TestValidateStages(t *testing.T) {
+	tests := []struct {
+		name    string
+		stages  string
+		wantErr string
+	}{
+		{
+			name:   "disjoint",
+			stages: `{"sandbox": {"ips": ["10.0.0.5"]}, "canary": {"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.19"}}`,
+		},
+		{
+			name:    "overlapping ranges",
+			stages:  `{"canary": {"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.19"}, "gray": {"rangeStart": "10.0.0.15", "rangeEnd": "10.0.0.25"}}`,
+			wantErr: "stage canary overlaps with stage gray",
+		},
+		{
+			name:    "ip inside another pool",
+			stages:  `{"canary": {"rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.19"}, "sandbox": {"ips": ["10.0.0.12"]}}`,
+			wantErr: "stage canary overlaps with stage sandbox",
+		},
+		{
+			name:    "pool outside range",
+			stages:  `{"canary": {"rangeStart": "10.0.1.10", "rangeEnd": "10.0.1.19"}}`,
+			wantErr: "stage canary pool 10.0.1.10-10.0.1.19 not in range",
+		},
+		{
+			name:    "half open pool",
+			stages:  `{"canary": {"rangeStart": "10.0.0.10"}}`,
+			wantErr: `stage "canary" must set both rangeStart and rangeEnd`,
+		},
+		{
+			name:    "empty pool",
+			stages:  `{"canary": {}}`,
+			wantErr: "stage canary has no ips",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := parseNetConf(t, `{"master": "eth0", "ipam": {"type": "neutron", "ranges": [[{"subnet": "10.0.0.0/24", "stages": `+tt.stages+`}]]}}`)
+			err := Validate(n)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
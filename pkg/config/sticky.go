@@ -0,0 +1,52 @@
+// copyright @ 2020 ops inc.
+
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+)
+
+const (
+	StickyKeyPodName = "podName" // 以pod名为身份, 如db-2
+	StickyKeyOrdinal = "ordinal" // 以pod名末尾的序号为身份, 如db-2中的2
+
+	DefaultStickyGracePeriod = 3600 // DEL后默认保留1小时
+)
+
+var ordinalRegex = regexp.MustCompile(`-(\d+)$`)
+
+// StickyConf 粘性ip: 分配绑定到pod的稳定身份, DEL后在gracePeriod内保留,
+// 该身份下次ADD时(任意主机)分配相同的ip, 用于StatefulSet之类的有状态服务
+type StickyConf struct {
+	Key         string `json:"key"`         // podName(默认)或ordinal
+	GracePeriod int    `json:"gracePeriod"` // DEL后保留的时间(秒), 默认3600
+}
+
+// Identity 根据pod名获取稳定身份
+func (c *StickyConf) Identity(podName string) (string, error) {
+	if podName == "" {
+		return "", fmt.Errorf("sticky ip requires K8S_POD_NAME")
+	}
+	switch c.Key {
+	case "", StickyKeyPodName:
+		return podName, nil
+	case StickyKeyOrdinal:
+		match := ordinalRegex.FindStringSubmatch(podName)
+		if match == nil {
+			return "", fmt.Errorf("can not parse ordinal from pod name %q", podName)
+		}
+		return match[1], nil
+	default:
+		return "", fmt.Errorf("unknown sticky key: %q", c.Key)
+	}
+}
+
+// Grace DEL后保留的时间
+func (c *StickyConf) Grace() time.Duration {
+	if c.GracePeriod <= 0 {
+		return DefaultStickyGracePeriod * time.Second
+	}
+	return time.Duration(c.GracePeriod) * time.Second
+}
@@ -0,0 +1,307 @@
+// copyright @ 2020 ops inc.
+
+package config
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+const (
+	maxIfNameLen = 15 // IFNAMSIZ - 1
+	minVlanID    = 1
+	maxVlanID    = 4094
+	minMTU       = 68
+	minMTUv6     = 1280
+	maxMTU       = 65535
+)
+
+// MacvlanModes 支持的macvlan模式. source模式只转发来自macaddrs列表中mac的流量,
+// 插件不支持配置该列表, 创建出的网卡会丢弃所有流量, 不允许使用
+var MacvlanModes = []string{"bridge", "private", "vepa", "passthru"}
+
+// ValidationError 服务配置校验错误, 包含所有发现的问题
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid service config: %s", strings.Join(e.Problems, "; "))
+}
+
+func (e *ValidationError) add(format string, args ...interface{}) {
+	e.Problems = append(e.Problems, fmt.Sprintf(format, args...))
+}
+
+// Validate 校验服务配置(master、vlan id、mtu、mode、ranges、sandbox、gateway、routes),
+// 一次返回全部问题; 不修改传入的配置. cmdAdd和neutronctl写入配置前都会调用
+func Validate(n *NetConf) error {
+	e := &ValidationError{}
+
+	validateMaster(n.Master, e)
+
+	if n.Mode == "source" {
+		e.add("mode \"source\" is not supported: it requires a macaddrs list")
+	} else if n.Mode != "" && !validMode(n.Mode) {
+		e.add("mode %q must be one of %s", n.Mode, strings.Join(MacvlanModes, ", "))
+	}
+
+	if n.IPAM == nil {
+		e.add("missing 'ipam' key, use an empty dictionary for interface only without ip address")
+	} else if n.IPAM.Type != "" {
+		validateIPAM(n.IPAM, e)
+	}
+
+	if n.MTU != 0 {
+		min := minMTU
+		if n.IPAM != nil && hasIPv6(n.IPAM) {
+			min = minMTUv6
+		}
+		if n.MTU < min || n.MTU > maxMTU {
+			e.add("mtu %d out of range [%d, %d]", n.MTU, min, maxMTU)
+		}
+	}
+
+	if len(e.Problems) > 0 {
+		return e
+	}
+	return nil
+}
+
+// validateMaster master为空时使用默认路由网卡; 形如bond0.388时需自动创建vlan子网卡
+func validateMaster(master string, e *ValidationError) {
+	if master == "" {
+		return
+	}
+	if len(master) > maxIfNameLen {
+		e.add("master %q longer than %d characters", master, maxIfNameLen)
+	}
+	if master == "." || master == ".." || strings.ContainsAny(master, "/: \t\n") {
+		e.add("master %q is not a valid interface name", master)
+	}
+
+	if !strings.Contains(master, ".") {
+		return
+	}
+	parts := strings.Split(master, ".")
+	if len(parts) != 2 || parts[0] == "" {
+		e.add("master %q must be <parent>.<vlan id>", master)
+		return
+	}
+	vlanID, err := strconv.Atoi(parts[1])
+	if err != nil {
+		e.add("master %q has invalid vlan id %q", master, parts[1])
+		return
+	}
+	if vlanID < minVlanID || vlanID > maxVlanID {
+		e.add("master %q vlan id %d out of range [%d, %d]", master, vlanID, minVlanID, maxVlanID)
+	}
+}
+
+func validMode(mode string) bool {
+	return contains(MacvlanModes, mode)
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func validateIPAM(ipam *IPAMConfig, e *ValidationError) {
+	// 与LoadIPAMConfig一致: 旧格式的单个range放在最前面
+	var rangesets []RangeSet
+	if ipam.Range != nil && ipam.Range.Subnet.IP != nil {
+		rangesets = append(rangesets, RangeSet{*ipam.Range})
+	}
+	for _, rs := range ipam.Ranges {
+		rangesets = append(rangesets, append(RangeSet{}, rs...))
+	}
+	if len(rangesets) == 0 {
+		e.add("ipam: no IP ranges specified")
+	}
+
+	valid := make([]RangeSet, 0, len(rangesets))
+	for i := range rangesets {
+		if validateRangeSet(i, rangesets[i], e) {
+			valid = append(valid, rangesets[i])
+		}
+	}
+
+	if ipam.BlockSize < 0 {
+		e.add("ipam: blockSize %d must not be negative", ipam.BlockSize)
+	} else if ipam.BlockSize > 0 {
+		for _, rs := range valid {
+			for _, r := range rs {
+				ones, bits := r.Subnet.Mask.Size()
+				if ipam.BlockSize < ones || ipam.BlockSize > bits {
+					e.add("ipam: blockSize %d out of range [%d, %d] for subnet %s", ipam.BlockSize, ones, bits, (*net.IPNet)(&r.Subnet).String())
+				}
+			}
+		}
+	}
+
+	for i := 0; i < len(valid); i++ {
+		for j := i + 1; j < len(valid); j++ {
+			if valid[i].Overlaps(&valid[j]) {
+				e.add("ipam: range set %s overlaps with %s", valid[i].String(), valid[j].String())
+			}
+		}
+	}
+
+	if ipam.Strategy != "" && !contains(Strategies, ipam.Strategy) {
+		e.add("ipam: strategy %q must be one of %s", ipam.Strategy, strings.Join(Strategies, ", "))
+	}
+
+	if ipam.Cooldown < 0 {
+		e.add("ipam: cooldown %d must not be negative", ipam.Cooldown)
+	}
+
+	if ipam.Sticky != nil {
+		if key := ipam.Sticky.Key; key != "" && key != StickyKeyPodName && key != StickyKeyOrdinal {
+			e.add("ipam: sticky key %q must be one of %s, %s", key, StickyKeyPodName, StickyKeyOrdinal)
+		}
+		if ipam.Sticky.GracePeriod < 0 {
+			e.add("ipam: sticky gracePeriod %d must not be negative", ipam.Sticky.GracePeriod)
+		}
+	}
+
+	for i, route := range ipam.Routes {
+		if route == nil || route.Dst.IP == nil {
+			e.add("ipam: route %d missing dst", i)
+			continue
+		}
+		if route.GW != nil && (route.GW.To4() == nil) != (route.Dst.IP.To4() == nil) {
+			e.add("ipam: route %d gw %s and dst %s address family mismatch", i, route.GW, route.Dst.String())
+		}
+	}
+}
+
+// validateRangeSet 校验单个range set(会规范化传入的副本), 全部合法时返回true
+func validateRangeSet(idx int, rs RangeSet, e *ValidationError) bool {
+	if len(rs) == 0 {
+		e.add("ipam: range set %d is empty", idx)
+		return false
+	}
+
+	ok := true
+	family := 0
+	for j := range rs {
+		r := &rs[j]
+		if r.Subnet.IP == nil {
+			e.add("ipam: range %d.%d missing subnet", idx, j)
+			ok = false
+			continue
+		}
+
+		// Canonicalize按rangeEnd检查rangeStart, 两者颠倒时只会报告rangeStart不在subnet内, 先检查顺序
+		if start, end := r.RangeStart.To16(), r.RangeEnd.To16(); start != nil && end != nil && ip.Cmp(start, end) > 0 {
+			e.add("ipam: range %d.%d rangeStart %s after rangeEnd %s", idx, j, r.RangeStart, r.RangeEnd)
+			ok = false
+			continue
+		}
+
+		// 网关在Canonicalize中可能被默认设置, 先记录是否显式配置
+		gateway := r.Gateway
+		if err := r.Canonicalize(); err != nil {
+			e.add("ipam: range %d.%d: %v", idx, j, err)
+			ok = false
+			continue
+		}
+		subnet := (*net.IPNet)(&r.Subnet)
+
+		if gateway != nil && !subnet.Contains(gateway) {
+			e.add("ipam: range %d.%d gateway %s not in subnet %s", idx, j, gateway, subnet.String())
+			ok = false
+		}
+		if ip.Cmp(r.RangeStart, r.RangeEnd) > 0 {
+			e.add("ipam: range %d.%d rangeStart %s after rangeEnd %s", idx, j, r.RangeStart, r.RangeEnd)
+			ok = false
+		}
+		if !validateStages(idx, j, r, e) {
+			ok = false
+		}
+
+		if family == 0 {
+			family = len(r.RangeStart)
+		} else if family != len(r.RangeStart) {
+			e.add("ipam: range set %d mixed address families", idx)
+			ok = false
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	for i := 0; i < len(rs); i++ {
+		for j := i + 1; j < len(rs); j++ {
+			if rs[i].Overlaps(&rs[j]) {
+				e.add("ipam: range set %d subnets %s and %s overlap", idx, rs[i].String(), rs[j].String())
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+// validateStages 发布阶段的ip池必须在range内, 且互不重叠
+func validateStages(idx, j int, r *Range, e *ValidationError) bool {
+	ok := true
+	names := make([]string, 0, len(r.Stages))
+	for name := range r.Stages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		pool := r.Stages[name]
+		for _, addr := range pool.IPs {
+			if !r.Contains(addr) {
+				e.add("ipam: range %d.%d stage %s ip %s not in range %s", idx, j, name, addr, r.String())
+				ok = false
+			}
+		}
+		if pool.RangeStart != nil {
+			if !r.Contains(pool.RangeStart) || !r.Contains(pool.RangeEnd) {
+				e.add("ipam: range %d.%d stage %s pool %s-%s not in range %s", idx, j, name, pool.RangeStart, pool.RangeEnd, r.String())
+				ok = false
+			} else if ip.Cmp(pool.RangeStart, pool.RangeEnd) > 0 {
+				e.add("ipam: range %d.%d stage %s rangeStart %s after rangeEnd %s", idx, j, name, pool.RangeStart, pool.RangeEnd)
+				ok = false
+			}
+		}
+		if pool.RangeStart == nil && len(pool.IPs) == 0 {
+			e.add("ipam: range %d.%d stage %s has no ips", idx, j, name)
+			ok = false
+		}
+	}
+
+	for a := 0; a < len(names); a++ {
+		for b := a + 1; b < len(names); b++ {
+			if r.Stages[names[a]].Overlaps(r.Stages[names[b]]) {
+				e.add("ipam: range %d.%d stage %s overlaps with stage %s", idx, j, names[a], names[b])
+				ok = false
+			}
+		}
+	}
+	return ok
+}
+
+func hasIPv6(ipam *IPAMConfig) bool {
+	for _, rs := range ipam.Ranges {
+		for _, r := range rs {
+			if r.Subnet.IP != nil && r.Subnet.IP.To4() == nil {
+				return true
+			}
+		}
+	}
+	return ipam.Range != nil && ipam.Range.Subnet.IP != nil && ipam.Range.Subnet.IP.To4() == nil
+}
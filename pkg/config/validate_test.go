@@ -0,0 +1,130 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantErr string
+	}{
+		{mode: ""},
+		{mode: "bridge"},
+		{mode: "private"},
+		{mode: "vepa"},
+		{mode: "passthru"},
+		{mode: "source", wantErr: `mode "source" is not supported`},
+		{mode: "bogus", wantErr: `mode "bogus" must be one of`},
+	}
+	for _, tt := range tests {
+		n := &NetConf{Master: "eth0", Mode: tt.mode, IPAM: &IPAMConfig{}}
+		err := Validate(n)
+		if tt.wantErr == "" {
+			if err != nil {
+				t.Errorf("mode %q: unexpected error: %v", tt.mode, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("mode %q: got error %v, want %q", tt.mode, err, tt.wantErr)
+		}
+	}
+}
+
+func parseNetConf(t *testing.T, data string) *NetConf {
+	t.Helper()
+	n := &NetConf{}
+	if err := json.Unmarshal([]byte(data), n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestValidateReportsAllProblems(t *testing.T) {
+	n := parseNetConf(t, `{
+		"master": "bond0.5000",
+		"mode": "bogus",
+		"mtu": 10,
+		"ipam": {
+			"type": "neutron",
+			"ranges": [[{"subnet": "10.0.0.0/24", "gateway": "10.0.1.1"}]],
+			"routes": [{"dst": "0.0.0.0/0", "gw": "fd00::1"}]
+		}
+	}`)
+	err := Validate(n)
+	verr, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("got %v, want a ValidationError", err)
+	}
+	wants := []string{
+		"vlan id 5000 out of range",
+		`mode "bogus"`,
+		"mtu 10 out of range",
+		"gateway 10.0.1.1 not in subnet 10.0.0.0/24",
+		"address family mismatch",
+	}
+	if len(verr.Problems) != len(wants) {
+		t.Errorf("got %d problems, want %d: %v", len(verr.Problems), len(wants), verr.Problems)
+	}
+	for _, want := range wants {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not report %q", err, want)
+		}
+	}
+}
+
+func TestValidateRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranges  string
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			ranges: `[[{"subnet": "10.0.0.0/24", "rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.20", "sandbox": ["10.0.0.11"]}]]`,
+		},
+		{
+			name:    "gateway outside subnet",
+			ranges:  `[[{"subnet": "10.0.0.0/24", "gateway": "192.168.0.1"}]]`,
+			wantErr: "gateway 192.168.0.1 not in subnet",
+		},
+		{
+			name:    "sandbox ip outside range",
+			ranges:  `[[{"subnet": "10.0.0.0/24", "rangeStart": "10.0.0.10", "rangeEnd": "10.0.0.20", "sandbox": ["10.0.0.30"]}]]`,
+			wantErr: "stage sandbox ip 10.0.0.30 not in range 10.0.0.10-10.0.0.20",
+		},
+		{
+			name:    "rangeStart after rangeEnd",
+			ranges:  `[[{"subnet": "10.0.0.0/24", "rangeStart": "10.0.0.20", "rangeEnd": "10.0.0.10"}]]`,
+			wantErr: "rangeStart 10.0.0.20 after rangeEnd 10.0.0.10",
+		},
+		{
+			name:    "overlapping range sets",
+			ranges:  `[[{"subnet": "10.0.0.0/24"}], [{"subnet": "10.0.0.0/25"}]]`,
+			wantErr: "overlaps with",
+		},
+		{
+			name:    "no ranges",
+			ranges:  `[]`,
+			wantErr: "no IP ranges specified",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := parseNetConf(t, `{"master": "eth0", "ipam": {"type": "neutron", "ranges": `+tt.ranges+`}}`)
+			err := Validate(n)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
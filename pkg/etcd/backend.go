@@ -5,11 +5,11 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
 
 	"neutron/pkg/log"
 )
@@ -29,130 +29,138 @@ func New(etcdClient *clientv3.Client, service, podname string) (*Store, error) {
 		Service:    service,
 		PodName:    podname,
 	}
-
-	// 初始当前服务的所有endpoints
-	endpoints, err := store.GetAllEndpoins()
-	if err != nil {
-		return nil, err
-	}
-	store.Endpoints = endpoints
 	return store, nil
 }
 
 // Store 采用etcd存储, 每个服务下的每个ip是一个key.
 type Store struct {
-	EtcdClient *clientv3.Client
-	Endpoints  []net.IP
-	HostName   string
-	Service    string
-	PodName    string
-}
+	EtcdClient  *clientv3.Client
+	HostName    string
+	Service     string
+	PodName     string
+	LockTTL     int           // 锁session租约时间(秒)
+	LockTimeout time.Duration // 获取锁的超时时间
+	Cooldown    time.Duration // 释放的ip的冷却时间, 0表示直接释放
 
-func (s *Store) Lock() error {
-	var (
-		leaseTTL int64 = 60
-		getLock        = false
-		key            = GetLockKey(s.Service)
-	)
-
-	kv := clientv3.NewKV(s.EtcdClient)
-	for {
-		// 申请一个租约
-		lease := clientv3.NewLease(s.EtcdClient)
-		leaseGrantResp, err := lease.Grant(context.TODO(), leaseTTL)
-		if err != nil {
-			return err
-		}
+	session *concurrency.Session
+	mutex   *concurrency.Mutex
+	indexed bool // 该服务已建立容器索引, 见BuildIndex
+}
 
-		// 获取租约id
-		leaseId := leaseGrantResp.ID
+// Lock 基于etcd session+mutex获取服务锁, session租约在持有锁期间自动续约,
+// 超过LockTimeout或ctx到期仍未获取到锁则返回错误
+func (s *Store) Lock(ctx context.Context) error {
+	return s.lock(ctx, GetLockKey(s.Service))
+}
 
-		// 创建一个事务
-		txn := kv.Txn(context.TODO())
-		txn.If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
-			Then(clientv3.OpPut(key, strconv.FormatInt(int64(leaseId), 10), clientv3.WithLease(leaseId))).
-			Else(clientv3.OpGet(key))
+// LockHost 只获取当前主机在该服务下的锁, 按块分配时不同主机之间互不阻塞
+func (s *Store) LockHost(ctx context.Context) error {
+	return s.lock(ctx, GetHostLockKey(s.Service, s.HostName))
+}
 
-		// 提交事务
-		txnResp, err := txn.Commit()
-		if err != nil {
-			return err
-		}
-		if txnResp.Succeeded {
-			getLock = true
-			break
-		}
+func (s *Store) lock(ctx context.Context, key string) error {
+	ttl := s.LockTTL
+	if ttl <= 0 {
+		ttl = DEFAULT_LOCK_TTL
+	}
+	timeout := s.LockTimeout
+	if timeout <= 0 {
+		timeout = DEFAULT_LOCK_TIMEOUT
+	}
 
-		// try again
-		time.Sleep(time.Millisecond * 100)
+	// session的租约申请随ctx取消, 避免etcd不可用时一直阻塞
+	session, err := concurrency.NewSession(s.EtcdClient, concurrency.WithTTL(ttl), concurrency.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("create lock session for %s failed: %v", key, err)
 	}
 
-	if getLock {
-		return nil
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	mutex := concurrency.NewMutex(session, key)
+	if err := mutex.Lock(ctx); err != nil {
+		session.Close()
+		return fmt.Errorf("acquire lock %s within %s failed: %v", key, timeout, err)
 	}
-	return fmt.Errorf("Can not get lock")
+	log.Infof("acquire lock %s with lease %x success", key, session.Lease())
+
+	s.session = session
+	s.mutex = mutex
+	return nil
 }
 
+// Unlock 只删除自己持有的锁, 并撤销自己的session租约.
+// 不使用调用方的ctx: 本次调用超时后仍需释放锁
 func (s *Store) Unlock() error {
-	key := GetLockKey(s.Service)
-	resp, err := s.EtcdClient.Get(context.TODO(), key)
-	if err != nil {
-		return err
+	if s.mutex == nil {
+		return nil
 	}
-	if resp.Count > 0 {
-		value := string(resp.Kvs[0].Value)
-		leaseId, err := strconv.ParseInt(value, 10, 64)
-		if err != nil {
-			return err
-		}
-		lease := clientv3.NewLease(s.EtcdClient)
-		lease.Revoke(context.TODO(), clientv3.LeaseID(leaseId))
+	defer func() {
+		s.session.Close()
+		s.session = nil
+		s.mutex = nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.TODO(), DEFAULT_LOCK_TIMEOUT)
+	defer cancel()
+	if err := s.mutex.Unlock(ctx); err != nil {
+		return fmt.Errorf("release lock %s failed: %v", s.mutex.Key(), err)
 	}
+	log.Infof("release lock %s success", s.mutex.Key())
 	return nil
 }
 
+// Close etcd client由存储后端统一管理, 此处不关闭
 func (s *Store) Close() error {
-	s.EtcdClient.Close()
 	return nil
 }
 
-func (s *Store) Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error) {
+func (s *Store) Reserve(ctx context.Context, rec *Record, ip net.IP) (bool, error) {
 	/*
-	 * param id: container id
-	 * param ifname: network interface name
+	 * param rec: 分配记录(container id、ifname、rangeID等)
 	 * param ip: reserve(预定) ip
-	 * param rangeID: range list index
 	 */
 	// key的格式: /neutron/endpoints/pay/10.21.28.4
 	key := fmt.Sprintf("%s/%s", GetEndpointsKey(s.Service), ip.String())
-	resp, err := s.EtcdClient.Get(context.TODO(), key)
+	value, err := rec.Marshal()
 	if err != nil {
 		return false, err
 	}
-	if resp.Count > 0 {
-		return false, nil
-	}
-
-	value := fmt.Sprintf("%s:%s:%s", s.HostName, id, s.PodName)
-	if _, err := s.EtcdClient.Put(context.TODO(), key, value); err != nil {
-		return false, nil
-	}
-	log.Infof("reserve store endpoint key: %s value: %s success", key, value)
 
 	// key的格式: /neutron/lastreserved/pay/0
-	key = fmt.Sprintf("%s/%s", GetLastReservedKey(s.Service), rangeID)
-	if _, err := s.EtcdClient.Put(context.TODO(), key, ip.String()); err != nil {
+	lastKey := fmt.Sprintf("%s/%s", GetLastReservedKey(s.Service), rec.RangeID)
+
+	// key的格式: /neutron/containers/<id>/<ifname>/10.21.28.4
+	indexKey := getIndexKey(rec.ContainerID, rec.IfName, ip)
+
+	// endpoint不存在时, 在同一个事务里写入endpoint、lastreserved、容器索引和分配主机;
+	// 指定ip分配时ip可能仍在冷却, 一并删除冷却key
+	txnResp, err := s.EtcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(
+			clientv3.OpPut(key, string(value)),
+			clientv3.OpPut(lastKey, ip.String()),
+			clientv3.OpPut(indexKey, key),
+			clientv3.OpPut(getHostIPKey(s.Service, ip), rec.Host),
+			clientv3.OpDelete(getReleasedIPKey(s.Service, ip)),
+		).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("reserve endpoint key: %s failed: %v", key, err)
+	}
+	if !txnResp.Succeeded {
+		log.Infof("reserve endpoint key: %s already exists", key)
 		return false, nil
 	}
-	log.Infof("reserve store lastreserved key: %s value: %s success", key, value)
+	log.Infof("reserve store endpoint key: %s value: %s lastreserved key: %s success", key, value, lastKey)
 	return true, nil
 }
 
 // LastReservedIP 返回指定rangeID下该服务分配的最后一个ip
-func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
+func (s *Store) LastReservedIP(ctx context.Context, rangeID string) (net.IP, error) {
 	// key的格式: /neutron/lastreserved/pay/0
 	key := fmt.Sprintf("%s/%s", GetLastReservedKey(s.Service), rangeID)
-	resp, err := s.EtcdClient.Get(context.TODO(), key)
+	resp, err := s.EtcdClient.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -163,118 +171,237 @@ func (s *Store) LastReservedIP(rangeID string) (net.IP, error) {
 	return net.ParseIP(data), nil
 }
 
-func (s *Store) Release(ip net.IP) error {
+func (s *Store) Release(ctx context.Context, ip net.IP) error {
 	// key的格式: /neutron/endpoints/pay/10.21.28.4
 	key := fmt.Sprintf("%s/%s", GetEndpointsKey(s.Service), ip.String())
-	if _, err := s.EtcdClient.Delete(context.TODO(), key); err != nil {
+	resp, err := s.EtcdClient.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+	if resp.Count == 0 {
+		return nil
+	}
+
+	ops := []clientv3.Op{clientv3.OpDelete(key)}
+	rec, err := ParseRecord(resp.Kvs[0].Value)
+	if err == nil {
+		if rec.Held() {
+			ops = append(ops, clientv3.OpDelete(getStickyIndexKey(s.Service, rec.Identity, ip)))
+		} else {
+			ops = append(ops, clientv3.OpDelete(getIndexKey(rec.ContainerID, rec.IfName, ip)))
+		}
+	}
+	// 粘性保留过期的ip已经空闲了gracePeriod, 不再冷却
+	leaseID := clientv3.NoLease
+	if err == nil && !rec.Held() {
+		var coolOps []clientv3.Op
+		coolOps, leaseID, err = s.coolOps(ctx, ip, resp.Kvs[0].Value)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, coolOps...)
+	}
+	// 读取之后endpoint被修改过(如被重新分配、取回)则不删除, 与releaseEntry一致
+	txnResp, err := s.EtcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		s.revokeCooldown(ip, leaseID)
 		return err
 	}
+	if !txnResp.Succeeded {
+		s.revokeCooldown(ip, leaseID)
+		log.Warnf("release endpoint key: %s skipped, it was modified concurrently", key)
+		return nil
+	}
 	log.Infof("release endpoint key: %s success", key)
 	return nil
 }
 
-// ReleaseByID This function eats errors to be tolerant and release as much as possible
-func (s *Store) ReleaseByID(id string, ifname string) error {
+// ReleaseByID 释放(container id, ifname)的所有ip, 某个ip释放失败时继续释放其余的ip, 最后返回所有错误
+func (s *Store) ReleaseByID(ctx context.Context, id string, ifname string) error {
 	/*
 	 * param id: container id
 	 * param ifname: network interface name
 	 */
-	key := GetEndpointsKey(s.Service)
-	resp, err := s.EtcdClient.Get(context.TODO(), key, clientv3.WithPrefix())
+	return s.ReleaseExcept(ctx, id, ifname, nil)
+}
+
+// ReleaseExcept 释放(container id, ifname)除keep以外的ip, ADD失败回滚时保留之前的ADD已分配的ip
+func (s *Store) ReleaseExcept(ctx context.Context, id string, ifname string, keep []net.IP) error {
+	entries, err := s.getIndex(ctx, id, ifname)
 	if err != nil {
 		return err
 	}
-	if resp.Count > 0 {
-		for _, kv := range resp.Kvs {
-			val := string(kv.Value)
-			valList := strings.Split(val, ":")
-			if len(valList) == 3 && valList[1] == id {
-				if _, err := s.EtcdClient.Delete(context.TODO(), string(kv.Key)); err != nil {
-					return err
-				}
-			}
-			log.Infof("release endpoint key: %s by container id: %s success", string(kv.Key), id)
+	var errs []string
+	for _, entry := range entries {
+		if ContainsIP(keep, entry.IP) {
+			continue
+		}
+		if err := s.releaseEntry(ctx, entry); err != nil {
+			log.Warnf("release endpoint key: %s failed: %v", entry.EndpointKey, err)
+			errs = append(errs, err.Error())
 		}
 	}
+	if len(errs) > 0 {
+		return fmt.Errorf("release container: %s failed: %s", id, strings.Join(errs, "; "))
+	}
 	return nil
 }
 
-// GetByID 返回指定container id已经分配的ip信息
-func (s *Store) GetByID(id string, ifname string) []net.IP {
+// releaseEntry endpoint和索引在同一个事务里删除; endpoint在读取后被修改过则不删除
+func (s *Store) releaseEntry(ctx context.Context, entry indexEntry) error {
+	txn := s.EtcdClient.Txn(ctx)
+	ops := []clientv3.Op{clientv3.OpDelete(entry.Key)}
+	leaseID := clientv3.NoLease
+	if entry.Record != nil {
+		txn = txn.If(clientv3.Compare(clientv3.ModRevision(entry.EndpointKey), "=", entry.ModRevision))
+		ops = append(ops, clientv3.OpDelete(entry.EndpointKey))
+
+		value, err := entry.Record.Marshal()
+		if err != nil {
+			return err
+		}
+		var coolOps []clientv3.Op
+		coolOps, leaseID, err = s.coolOps(ctx, entry.IP, value)
+		if err != nil {
+			return err
+		}
+		ops = append(ops, coolOps...)
+	}
+	txnResp, err := txn.Then(ops...).Commit()
+	if err != nil {
+		s.revokeCooldown(entry.IP, leaseID)
+		return err
+	}
+	if !txnResp.Succeeded {
+		s.revokeCooldown(entry.IP, leaseID)
+		log.Warnf("release endpoint key: %s skipped, it was modified concurrently", entry.EndpointKey)
+		return nil
+	}
+	log.Infof("release endpoint key: %s by index key: %s success", entry.EndpointKey, entry.Key)
+	return nil
+}
+
+// GetByID 返回指定(container id, ifname)已经分配的ip信息
+func (s *Store) GetByID(ctx context.Context, id string, ifname string) ([]net.IP, error) {
 	/*
 	 * param id: container id
 	 * param ifname: network interface name
 	 */
-	result := make([]net.IP, 0)
-	key := GetEndpointsKey(s.Service)
-	resp, err := s.EtcdClient.Get(context.TODO(), key, clientv3.WithPrefix())
+	entries, err := s.getIndex(ctx, id, ifname)
 	if err != nil {
-		return nil
+		return nil, err
 	}
-	if resp.Count > 0 {
-		for _, kv := range resp.Kvs {
-			val := string(kv.Value)
-			valList := strings.Split(val, ":")
-			if len(valList) == 3 && valList[1] == id {
-				curKey := string(kv.Key)
-				keyInfo := strings.Split(curKey, "/")
-				ip := keyInfo[len(keyInfo)-1]
-				result = append(result, net.ParseIP(ip))
-				return result
-			}
+	var result []net.IP
+	for _, entry := range entries {
+		if entry.Record != nil {
+			result = append(result, entry.IP)
 		}
 	}
-	return nil
+	return result, nil
 }
 
-// FindByID 查询container id是否已分配ip
-func (s *Store) FindByID(id string, ifname string) bool {
+// FindByID 查询(container id, ifname)是否已分配ip
+func (s *Store) FindByID(ctx context.Context, id string, ifname string) (bool, error) {
 	/*
 	 * param id: container id
 	 * param ifname: network interface name
 	 */
-	key := GetEndpointsKey(s.Service)
-	resp, err := s.EtcdClient.Get(context.TODO(), key, clientv3.WithPrefix())
+	ips, err := s.GetByID(ctx, id, ifname)
+	return len(ips) > 0, err
+}
+
+// ListAllocations 获取当前服务所有已分配的ip及其分配记录
+func (s *Store) ListAllocations(ctx context.Context) ([]Allocation, error) {
+	endpoints, err := s.listEndpoints(ctx)
 	if err != nil {
-		return false
-	}
-	if resp.Count > 0 {
-		for _, kv := range resp.Kvs {
-			val := string(kv.Value)
-			valList := strings.Split(val, ":")
-			if len(valList) == 3 && valList[1] == id {
-				return true
-			}
-		}
+		return nil, err
+	}
+	results := make([]Allocation, 0, len(endpoints))
+	for _, ep := range endpoints {
+		results = append(results, Allocation{IP: ep.IP, Record: ep.Record})
 	}
-	return false
+	return results, nil
+}
+
+// endpoint 已分配的ip及其分配记录
+type endpoint struct {
+	Key    string
+	IP     net.IP
+	Record *Record
 }
 
-// GetAllEndpoins 获取当前服务所有的ip列表
-func (s *Store) GetAllEndpoins() ([]net.IP, error) {
-	results := make([]net.IP, 0)
+// listEndpoints 获取当前服务所有的endpoint, 旧格式的记录自动迁移为json格式
+func (s *Store) listEndpoints(ctx context.Context) ([]endpoint, error) {
 	key := GetEndpointsKey(s.Service)
-	resp, err := s.EtcdClient.Get(context.TODO(), key, clientv3.WithPrefix())
+	resp, err := s.EtcdClient.Get(ctx, key+"/", clientv3.WithPrefix())
 	if err != nil {
 		return nil, err
 	}
-	if resp.Count > 0 {
-		for _, kv := range resp.Kvs {
-			curKey := string(kv.Value)
-			keyInfo := strings.Split(curKey, "/")
-			ip := keyInfo[len(keyInfo)-1]
-			results = append(results, net.ParseIP(ip))
+
+	results := make([]endpoint, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		curKey := string(kv.Key)
+		rec, err := ParseRecord(kv.Value)
+		if err != nil {
+			log.Warnf("skip endpoint key: %s: %v", curKey, err)
+			continue
+		}
+		if rec.Legacy() {
+			rec = s.migrate(ctx, kv.Key, kv.ModRevision, rec)
 		}
+		keyInfo := strings.Split(curKey, "/")
+		ip := keyInfo[len(keyInfo)-1]
+		results = append(results, endpoint{Key: curKey, IP: net.ParseIP(ip), Record: rec})
 	}
 	return results, nil
 }
 
-// IsIPExist 判断当前获取的ip是否在已分配的ip列表里
-func (s *Store) IsIPExist(ip net.IP) bool {
-	for _, v := range s.Endpoints {
-		if v.Equal(ip) {
-			return true
+// migrate 将旧格式记录以json重新写回, 同时补写容器索引(旧版本节点写入的记录没有索引);
+// key在读取后被修改过则放弃
+func (s *Store) migrate(ctx context.Context, key []byte, modRevision int64, rec *Record) *Record {
+	newRec := rec.Migrate()
+	value, err := newRec.Marshal()
+	if err != nil {
+		return rec
+	}
+	keyInfo := strings.Split(string(key), "/")
+	ip := net.ParseIP(keyInfo[len(keyInfo)-1])
+	ops := []clientv3.Op{clientv3.OpPut(string(key), string(value))}
+	if ip != nil {
+		ops = append(ops, clientv3.OpPut(getIndexKey(newRec.ContainerID, newRec.IfName, ip), string(key)))
+	}
+	_, err = s.EtcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(string(key)), "=", modRevision)).
+		Then(ops...).
+		Commit()
+	if err != nil {
+		log.Warnf("migrate endpoint key: %s failed: %v", string(key), err)
+		return rec
+	}
+	log.Infof("migrate endpoint key: %s value: %s success", string(key), value)
+	return newRec
+}
+
+// GetAllEndpoins 获取当前服务所有已分配的ip列表, ip取自endpoint的key
+func (s *Store) GetAllEndpoins(ctx context.Context) ([]net.IP, error) {
+	// key的格式: /neutron/endpoints/pay/10.21.28.4
+	prefix := GetEndpointsKey(s.Service) + "/"
+	resp, err := s.EtcdClient.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]net.IP, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		ip := net.ParseIP(strings.TrimPrefix(string(kv.Key), prefix))
+		if ip == nil {
+			log.Warnf("skip invalid endpoint key: %s", string(kv.Key))
+			continue
 		}
+		results = append(results, ip)
 	}
-	return false
+	return results, nil
 }
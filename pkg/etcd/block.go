@@ -0,0 +1,102 @@
+// copyright @ 2020 ops inc.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	"github.com/coreos/etcd/clientv3"
+
+	"neutron/pkg/log"
+)
+
+// blockTxnOps BlockInUse一个事务中的读取数, 不超过etcd默认的--max-txn-ops(128)
+const blockTxnOps = 128
+
+// key的格式: /neutron/blocks/pay/10.21.28.16/28, value为主机名
+func getBlockKey(service string, block *net.IPNet) string {
+	return fmt.Sprintf("%s/%s", GetBlocksKey(service), block.String())
+}
+
+// GetBlocks 获取当前服务已申领的块
+func (s *Store) GetBlocks(ctx context.Context) (map[string]string, error) {
+	prefix := GetBlocksKey(s.Service) + "/"
+	resp, err := s.EtcdClient.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		results[strings.TrimPrefix(string(kv.Key), prefix)] = string(kv.Value)
+	}
+	return results, nil
+}
+
+// ClaimBlock 块的key不存在时写入主机名, 多个主机同时申领时只有一个成功
+func (s *Store) ClaimBlock(ctx context.Context, block *net.IPNet, host string) (bool, error) {
+	key := getBlockKey(s.Service, block)
+	txnResp, err := s.EtcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, host)).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("claim block key: %s failed: %v", key, err)
+	}
+	if !txnResp.Succeeded {
+		log.Infof("claim block key: %s already claimed", key)
+		return false, nil
+	}
+	log.Infof("claim block key: %s for host: %s success", key, host)
+	return true, nil
+}
+
+// ReleaseBlock 只删除仍由host持有的块
+func (s *Store) ReleaseBlock(ctx context.Context, block *net.IPNet, host string) error {
+	key := getBlockKey(s.Service, block)
+	txnResp, err := s.EtcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.Value(key), "=", host)).
+		Then(clientv3.OpDelete(key)).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("release block key: %s failed: %v", key, err)
+	}
+	if txnResp.Succeeded {
+		log.Infof("release block key: %s of host: %s success", key, host)
+	}
+	return nil
+}
+
+// BlockInUse 块内是否还有分配记录(包括粘性保留). endpoint的key是ip字符串, 字典序与地址顺序不一致,
+// 不能用一个范围读取覆盖整个块; 对块内每个ip做count-only读取, 每个事务最多blockTxnOps个, 不读取value
+func (s *Store) BlockInUse(ctx context.Context, block *net.IPNet) (bool, error) {
+	last := make(net.IP, len(block.IP))
+	for i := range block.IP {
+		last[i] = block.IP[i] | ^block.Mask[i]
+	}
+	ops := make([]clientv3.Op, 0, blockTxnOps)
+	for cur := block.IP; ; cur = ip.NextIP(cur) {
+		key := fmt.Sprintf("%s/%s", GetEndpointsKey(s.Service), cur.String())
+		ops = append(ops, clientv3.OpGet(key, clientv3.WithCountOnly()))
+		done := cur.Equal(last)
+		if len(ops) == blockTxnOps || done {
+			txnResp, err := s.EtcdClient.Txn(ctx).Then(ops...).Commit()
+			if err != nil {
+				return false, fmt.Errorf("check block: %s in use failed: %v", block, err)
+			}
+			for _, resp := range txnResp.Responses {
+				if resp.GetResponseRange().Count > 0 {
+					return true, nil
+				}
+			}
+			ops = ops[:0]
+		}
+		if done {
+			return false, nil
+		}
+	}
+}
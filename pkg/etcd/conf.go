@@ -2,22 +2,43 @@ package etcd
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/namespace"
 	"github.com/coreos/etcd/pkg/transport"
 
 	"neutron/pkg/log"
-	"neutron/pkg/util"
 )
 
+// 以下key都在EtcdConf.Prefix(默认/neutron)之下, 前缀由client的namespace统一添加
 const (
-	ETCD_BASE          = "/neutron"
-	ETCD_SERVICE       = ETCD_BASE + "/service"
-	ETCD_ENDPOINTS     = ETCD_BASE + "/endpoints"
-	ETCD_LAST_RESERVED = ETCD_BASE + "/lastreserved"
-	ETCD_LOCK          = ETCD_BASE + "/lock"
+	ETCD_SERVICE       = "/service"
+	ETCD_ENDPOINTS     = "/endpoints"
+	ETCD_LAST_RESERVED = "/lastreserved"
+	ETCD_LOCK          = "/lock"
+	ETCD_CONTAINERS    = "/containers"
+	ETCD_INDEXED       = "/indexed"
+	ETCD_STICKY        = "/sticky"
+	ETCD_RELEASED      = "/released"
+	ETCD_HOSTS         = "/hosts"
+	ETCD_BLOCKS        = "/blocks"
+	ETCD_HOST_LOCK     = "/hostlock"
+
+	DEFAULT_PREFIX          = "/neutron"
+	DEFAULT_DIAL_TIMEOUT    = 5 * time.Second  // 连接etcd超时时间
+	DEFAULT_REQUEST_TIMEOUT = 10 * time.Second // 单次etcd请求超时时间
+	DEFAULT_LOCK_TTL        = 60               // 锁租约时间(秒)
+	DEFAULT_LOCK_TIMEOUT    = 30 * time.Second // 获取锁超时时间
+
+	DEFAULT_RETRY_ATTEMPTS   = 4                      // etcd请求总尝试次数
+	DEFAULT_RETRY_BASE_DELAY = 100 * time.Millisecond // 第一次重试前的等待时间
+	DEFAULT_RETRY_MAX_DELAY  = 2 * time.Second        // 重试等待时间上限
 )
 
 func GetServiceKey(service string) string {
@@ -36,52 +57,179 @@ func GetLockKey(service string) string {
 	return fmt.Sprintf("%s/%s", ETCD_LOCK, service)
 }
 
+// GetContainerKey 容器索引key: /neutron/containers/<id>/<ifname>, 其下每个ip一个key
+func GetContainerKey(id, ifname string) string {
+	return fmt.Sprintf("%s/%s/%s", ETCD_CONTAINERS, id, ifname)
+}
+
+// GetIndexedKey 标记该服务的容器索引已建立
+func GetIndexedKey(service string) string {
+	return fmt.Sprintf("%s/%s", ETCD_INDEXED, service)
+}
+
+// GetStickyKey 粘性ip索引: /neutron/sticky/<service>/<identity>, 其下每个保留的ip一个key
+func GetStickyKey(service, identity string) string {
+	return fmt.Sprintf("%s/%s/%s", ETCD_STICKY, service, identity)
+}
+
+// GetReleasedKey 冷却中的ip: /neutron/released/<service>, 其下每个ip一个key
+func GetReleasedKey(service string) string {
+	return fmt.Sprintf("%s/%s", ETCD_RELEASED, service)
+}
+
+// GetHostsKey ip最后一次分配所在的主机: /neutron/hosts/<service>, 其下每个ip一个key
+func GetHostsKey(service string) string {
+	return fmt.Sprintf("%s/%s", ETCD_HOSTS, service)
+}
+
+// GetBlocksKey 按块分配时各主机申领的块: /neutron/blocks/<service>, 其下每个块(cidr)一个key, 值为主机名
+func GetBlocksKey(service string) string {
+	return fmt.Sprintf("%s/%s", ETCD_BLOCKS, service)
+}
+
+// GetHostLockKey 主机锁: /neutron/hostlock/<service>/<host>, 与服务锁不在同一前缀下, 互不排队
+func GetHostLockKey(service, host string) string {
+	return fmt.Sprintf("%s/%s/%s", ETCD_HOST_LOCK, service, host)
+}
+
 func NewEtcdConf() *EtcdConf {
 	return &EtcdConf{}
 }
 
 type EtcdConf struct {
-	URLs     string `json:"urls"`
-	CAFile   string `json:"cafile"`
-	KeyFile  string `json:"keyfile"`
-	CertFile string `json:"certfile"`
+	URLs           Endpoints  `json:"urls"` // 逗号分隔的字符串或数组
+	CAFile         string     `json:"cafile"`
+	KeyFile        string     `json:"keyfile"`
+	CertFile       string     `json:"certfile"`
+	Username       string     `json:"username,omitempty"`
+	Password       string     `json:"password,omitempty"`
+	DialTimeout    int        `json:"dialTimeout,omitempty"`    // 连接超时时间(秒)
+	RequestTimeout int        `json:"requestTimeout,omitempty"` // 单次请求超时时间(秒)
+	Prefix         string     `json:"prefix,omitempty"`         // 所有key的前缀, 多个集群共用一个etcd时区分
+	Retry          *RetryConf `json:"retry,omitempty"`          // etcd短暂不可用时的重试策略
+	LockTTL        int        `json:"lockTTL"`                  // 锁租约时间(秒), 持有期间自动续约
+	LockTimeout    int        `json:"lockTimeout"`              // 获取锁超时时间(秒)
+}
+
+// Endpoints etcd地址列表, 配置中可以是逗号分隔的字符串或字符串数组
+type Endpoints []string
+
+func (e *Endpoints) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		var urls string
+		if err := json.Unmarshal(data, &urls); err != nil {
+			return fmt.Errorf("etcd urls must be a string or an array of strings")
+		}
+		list = strings.Split(urls, ",")
+	}
+
+	*e = Endpoints{}
+	for _, url := range list {
+		if url = strings.TrimSpace(url); url != "" {
+			*e = append(*e, url)
+		}
+	}
+	return nil
+}
+
+// KeyPrefix 所有key的前缀, 未配置时为/neutron
+func (ec *EtcdConf) KeyPrefix() string {
+	prefix := strings.TrimRight(ec.Prefix, "/")
+	if prefix == "" {
+		return DEFAULT_PREFIX
+	}
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+func (ec *EtcdConf) dialTimeout() time.Duration {
+	if ec.DialTimeout <= 0 {
+		return DEFAULT_DIAL_TIMEOUT
+	}
+	return time.Duration(ec.DialTimeout) * time.Second
 }
 
-// Connect 连接etcd, 采用tls认证
-func (ec *EtcdConf) Connect(urls, caFile, keyFile, certFile string) (*clientv3.Client, error) {
-	tlsInfo := transport.TLSInfo{
-		CertFile:      certFile,
-		KeyFile:       keyFile,
-		TrustedCAFile: caFile,
+func (ec *EtcdConf) requestTimeout() time.Duration {
+	if ec.RequestTimeout <= 0 {
+		return DEFAULT_REQUEST_TIMEOUT
+	}
+	return time.Duration(ec.RequestTimeout) * time.Second
+}
+
+// Connect 连接etcd; 配置了cafile/certfile/keyfile时采用tls认证, 否则明文连接(仅用于测试集群).
+// 返回的client每次请求带RequestTimeout超时, 读和幂等写按Retry重试, 所有key自动加上KeyPrefix前缀
+func (ec *EtcdConf) Connect() (*clientv3.Client, error) {
+	if len(ec.URLs) == 0 {
+		return nil, fmt.Errorf("etcd urls is empty")
+	}
+
+	conf := clientv3.Config{
+		Endpoints:   ec.URLs,
+		DialTimeout: ec.dialTimeout(),
+		Username:    ec.Username,
+		Password:    ec.Password,
+	}
+	if ec.CAFile != "" || ec.CertFile != "" || ec.KeyFile != "" {
+		tlsInfo := transport.TLSInfo{
+			CertFile:      ec.CertFile,
+			KeyFile:       ec.KeyFile,
+			TrustedCAFile: ec.CAFile,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, err
+		}
+		conf.TLS = tlsConfig
 	}
 
-	tlsConfig, err := tlsInfo.ClientConfig()
+	cli, err := clientv3.New(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	cli, err := clientv3.New(clientv3.Config{
-		Endpoints:   []string{urls},
-		DialTimeout: 5 * time.Second,
-		TLS:         tlsConfig,
-	})
-	return cli, err
+	prefix := ec.KeyPrefix()
+	cli.KV = namespace.NewKV(newTimeoutKV(cli.KV, ec.requestTimeout(), ec.Retry), prefix)
+	cli.Watcher = namespace.NewWatcher(cli.Watcher, prefix)
+	cli.Lease = namespace.NewLease(cli.Lease, prefix)
+	log.Infof("connect etcd endpoints: %v prefix: %s tls: %t", ec.URLs, prefix, conf.TLS != nil)
+	return cli, nil
 }
 
-// GetServiceConf 根据CNI_ARGS获取服务名, 根据服务名从etcd获取配置
-func (ec *EtcdConf) GetServiceConf(etcdClient *clientv3.Client, envArgs string) ([]byte, error) {
-	service, _ := util.GetCurrentServiceAndPod(envArgs)
-	if service == "" {
-		return nil, fmt.Errorf("fetch service from args: %s is empty", envArgs)
-	}
+// Ping 检查etcd是否可用: 只读取一个key的数量, 不扫描任何前缀, 供STATUS频繁调用
+func (ec *EtcdConf) Ping(ctx context.Context, etcdClient *clientv3.Client) error {
+	_, err := etcdClient.Get(ctx, ETCD_SERVICE, clientv3.WithCountOnly())
+	return err
+}
 
-	return ec.GetConfigFromEtcd(etcdClient, service)
+// ListServices 获取有服务配置或有已分配ip的所有服务名
+func (ec *EtcdConf) ListServices(ctx context.Context, etcdClient *clientv3.Client) ([]string, error) {
+	services := []string{}
+	seen := map[string]bool{}
+	for _, prefix := range []string{ETCD_SERVICE + "/", ETCD_ENDPOINTS + "/"} {
+		resp, err := etcdClient.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		if err != nil {
+			return nil, err
+		}
+		for _, kv := range resp.Kvs {
+			// key的格式: /neutron/service/pay 或 /neutron/endpoints/pay/10.21.28.4
+			service := strings.SplitN(strings.TrimPrefix(string(kv.Key), prefix), "/", 2)[0]
+			if service != "" && !seen[service] {
+				seen[service] = true
+				services = append(services, service)
+			}
+		}
+	}
+	sort.Strings(services)
+	return services, nil
 }
 
 // GetConfigFromEtcd 从etcd中获取macvlan配置+ipam配置(真正的配置)
-func (ec *EtcdConf) GetConfigFromEtcd(etcdClient *clientv3.Client, service string) ([]byte, error) {
+func (ec *EtcdConf) GetConfigFromEtcd(ctx context.Context, etcdClient *clientv3.Client, service string) ([]byte, error) {
 	key := GetServiceKey(service)
-	resp, err := etcdClient.Get(context.TODO(), key)
+	resp, err := etcdClient.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -93,3 +241,48 @@ func (ec *EtcdConf) GetConfigFromEtcd(etcdClient *clientv3.Client, service strin
 	log.Infof("Get key: %s from etcd value: %s", key, string(value))
 	return value, nil
 }
+
+// PutConfigToEtcd 写入服务的macvlan+ipam配置
+func (ec *EtcdConf) PutConfigToEtcd(ctx context.Context, etcdClient *clientv3.Client, service string, value []byte) error {
+	key := GetServiceKey(service)
+	if _, err := etcdClient.Put(ctx, key, string(value)); err != nil {
+		return err
+	}
+	log.Infof("Put key: %s to etcd value: %s", key, string(value))
+	return nil
+}
+
+// RetryConf etcd请求失败的重试策略, 等待时间按指数增长并加上随机抖动
+type RetryConf struct {
+	MaxAttempts int `json:"maxAttempts"` // 总尝试次数(包括第一次), 1表示不重试
+	BaseDelay   int `json:"baseDelay"`   // 第一次重试前的等待时间(毫秒), 之后每次翻倍
+	MaxDelay    int `json:"maxDelay"`    // 单次等待时间上限(毫秒)
+}
+
+func (r *RetryConf) attempts() int {
+	if r == nil || r.MaxAttempts <= 0 {
+		return DEFAULT_RETRY_ATTEMPTS
+	}
+	return r.MaxAttempts
+}
+
+// backoff 第attempt次失败后的等待时间: 在[d/2, d]之间随机, d = baseDelay * 2^(attempt-1), 不超过maxDelay
+func (r *RetryConf) backoff(attempt int) time.Duration {
+	base, max := DEFAULT_RETRY_BASE_DELAY, DEFAULT_RETRY_MAX_DELAY
+	if r != nil && r.BaseDelay > 0 {
+		base = time.Duration(r.BaseDelay) * time.Millisecond
+	}
+	if r != nil && r.MaxDelay > 0 {
+		max = time.Duration(r.MaxDelay) * time.Millisecond
+	}
+
+	d := base
+	for i := 1; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)+1))
+}
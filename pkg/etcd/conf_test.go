@@ -0,0 +1,41 @@
+package etcd
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestEndpointsUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    Endpoints
+		wantErr bool
+	}{
+		{name: "string", data: `"http://a:2379"`, want: Endpoints{"http://a:2379"}},
+		{name: "comma separated", data: `" http://a:2379, http://b:2379 ,"`, want: Endpoints{"http://a:2379", "http://b:2379"}},
+		{name: "list", data: `["http://a:2379", " http://b:2379", ""]`, want: Endpoints{"http://a:2379", "http://b:2379"}},
+		{name: "empty", data: `""`, want: Endpoints{}},
+		{name: "number", data: `2379`, wantErr: true},
+		{name: "list of numbers", data: `[2379]`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var conf EtcdConf
+			err := json.Unmarshal([]byte(`{"urls": `+tt.data+`}`), &conf)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v, want error", conf.URLs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(conf.URLs, tt.want) {
+				t.Errorf("got %q, want %q", conf.URLs, tt.want)
+			}
+		})
+	}
+}
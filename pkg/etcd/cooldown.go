@@ -0,0 +1,97 @@
+// copyright @ 2020 ops inc.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"neutron/pkg/log"
+)
+
+// key的格式: /neutron/hosts/pay/10.21.28.4, value为主机名
+func getHostIPKey(service string, ip net.IP) string {
+	return fmt.Sprintf("%s/%s", GetHostsKey(service), ip.String())
+}
+
+func getReleasedIPKey(service string, ip net.IP) string {
+	return fmt.Sprintf("%s/%s", GetReleasedKey(service), ip.String())
+}
+
+// SetCooldown 设置之后释放的ip的冷却时间
+func (s *Store) SetCooldown(cooldown time.Duration) {
+	s.Cooldown = cooldown
+}
+
+// coolOps 释放ip时把原分配记录写入冷却key, 绑定cooldown租约, 到期由etcd自动删除.
+// 返回的租约需要在事务失败或未执行时用revokeCooldown撤销, 没有冷却时为NoLease
+func (s *Store) coolOps(ctx context.Context, ip net.IP, value []byte) ([]clientv3.Op, clientv3.LeaseID, error) {
+	if s.Cooldown <= 0 {
+		return nil, clientv3.NoLease, nil
+	}
+	ttl := int64(s.Cooldown / time.Second)
+	if ttl <= 0 {
+		ttl = 1
+	}
+	lease, err := s.EtcdClient.Grant(ctx, ttl)
+	if err != nil {
+		return nil, clientv3.NoLease, fmt.Errorf("grant cooldown lease for ip: %s failed: %v", ip, err)
+	}
+	log.Infof("cool down released ip: %s for %s", ip, s.Cooldown)
+	return []clientv3.Op{clientv3.OpPut(getReleasedIPKey(s.Service, ip), string(value), clientv3.WithLease(lease.ID))}, lease.ID, nil
+}
+
+// revokeCooldown 释放的事务失败或因比较失败未执行时撤销冷却租约, 避免留下无用的租约
+func (s *Store) revokeCooldown(ip net.IP, leaseID clientv3.LeaseID) {
+	s.revokeLease(leaseID, "cooldown lease for ip: "+ip.String())
+}
+
+// revokeLease 撤销写入失败时未使用的租约. 调用方的ctx可能已经到期, 使用独立的ctx;
+// 撤销失败时租约到期后由etcd自动删除
+func (s *Store) revokeLease(leaseID clientv3.LeaseID, what string) {
+	if leaseID == clientv3.NoLease {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), DEFAULT_REQUEST_TIMEOUT)
+	defer cancel()
+	if _, err := s.EtcdClient.Revoke(ctx, leaseID); err != nil {
+		log.Warnf("revoke %s failed: %v", what, err)
+	}
+}
+
+// GetCooling 获取当前服务仍在冷却的ip, ip取自key
+func (s *Store) GetCooling(ctx context.Context) ([]net.IP, error) {
+	prefix := GetReleasedKey(s.Service) + "/"
+	resp, err := s.EtcdClient.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]net.IP, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		if ip := net.ParseIP(strings.TrimPrefix(string(kv.Key), prefix)); ip != nil {
+			results = append(results, ip)
+		}
+	}
+	return results, nil
+}
+
+// GetLastHosts 获取当前服务每个ip最后一次分配所在的主机, ip释放后仍然保留
+func (s *Store) GetLastHosts(ctx context.Context) (map[string]string, error) {
+	prefix := GetHostsKey(s.Service) + "/"
+	resp, err := s.EtcdClient.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]string, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		results[strings.TrimPrefix(string(kv.Key), prefix)] = string(kv.Value)
+	}
+	return results, nil
+}
@@ -0,0 +1,192 @@
+// copyright @ 2020 ops inc.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"neutron/pkg/log"
+)
+
+// 单个etcd事务的op数量有限制(默认128), 建立索引时分批写入
+const indexBatchSize = 100
+
+// indexEntry 容器索引项: /neutron/containers/<id>/<ifname>/<ip> -> endpoint key
+type indexEntry struct {
+	Key         string
+	EndpointKey string
+	IP          net.IP
+
+	// 索引指向的endpoint记录, endpoint已不存在或已不属于该容器时为nil
+	Record      *Record
+	ModRevision int64
+}
+
+func getIndexKey(id, ifname string, ip net.IP) string {
+	return fmt.Sprintf("%s/%s", GetContainerKey(id, ifname), ip.String())
+}
+
+// getIndex 根据容器索引直接读取(container id, ifname)在当前服务下的endpoint;
+// 旧格式迁移来的记录没有ifname, 索引在/neutron/containers/<id>//<ip>下, 匹配任意ifname.
+// 索引中没有记录且该服务还没有建立索引(BuildIndex)时按前缀扫描endpoint, 见scanEndpoints
+func (s *Store) getIndex(ctx context.Context, id, ifname string) ([]indexEntry, error) {
+	prefix := fmt.Sprintf("%s/%s/", ETCD_CONTAINERS, id)
+	resp, err := s.EtcdClient.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	endpointsPrefix := GetEndpointsKey(s.Service) + "/"
+	results := make([]indexEntry, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		// 去掉前缀后为: <ifname>/<ip>
+		rest := strings.TrimPrefix(string(kv.Key), prefix)
+		pos := strings.LastIndex(rest, "/")
+		if pos < 0 {
+			continue
+		}
+		curIfname, ip := rest[:pos], rest[pos+1:]
+		if curIfname != "" && curIfname != ifname {
+			continue
+		}
+		epKey := string(kv.Value)
+		if !strings.HasPrefix(epKey, endpointsPrefix) {
+			continue
+		}
+
+		entry := indexEntry{Key: string(kv.Key), EndpointKey: epKey, IP: net.ParseIP(ip)}
+		epResp, err := s.EtcdClient.Get(ctx, epKey)
+		if err != nil {
+			return nil, err
+		}
+		if epResp.Count > 0 {
+			rec, err := ParseRecord(epResp.Kvs[0].Value)
+			if err == nil && rec.Match(id, ifname) {
+				entry.Record = rec
+				entry.ModRevision = epResp.Kvs[0].ModRevision
+			}
+		}
+		if entry.Record == nil {
+			log.Warnf("container index key: %s points to stale endpoint: %s", entry.Key, epKey)
+		}
+		results = append(results, entry)
+	}
+	if len(results) == 0 {
+		indexed, err := s.isIndexed(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !indexed {
+			return s.scanEndpoints(ctx, id, ifname)
+		}
+	}
+	return results, nil
+}
+
+// isIndexed 该服务是否已经建立索引; 建立之后不会撤销, 结果缓存在Store中
+func (s *Store) isIndexed(ctx context.Context) (bool, error) {
+	if s.indexed {
+		return true, nil
+	}
+	resp, err := s.EtcdClient.Get(ctx, GetIndexedKey(s.Service), clientv3.WithCountOnly())
+	if err != nil {
+		return false, err
+	}
+	s.indexed = resp.Count > 0
+	return s.indexed, nil
+}
+
+// scanEndpoints 服务还没有建立索引时(可能还有旧版本的节点在写入没有索引的endpoint), 按前缀扫描该服务的endpoint
+// 查找(container id, ifname)的记录, 并为找到的记录补写索引
+func (s *Store) scanEndpoints(ctx context.Context, id, ifname string) ([]indexEntry, error) {
+	prefix := GetEndpointsKey(s.Service) + "/"
+	resp, err := s.EtcdClient.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var results []indexEntry
+	for _, kv := range resp.Kvs {
+		rec, err := ParseRecord(kv.Value)
+		if err != nil || rec.Held() || !rec.Match(id, ifname) {
+			continue
+		}
+		ip := net.ParseIP(strings.TrimPrefix(string(kv.Key), prefix))
+		if ip == nil {
+			continue
+		}
+		entry := indexEntry{
+			Key:         getIndexKey(rec.ContainerID, rec.IfName, ip),
+			EndpointKey: string(kv.Key),
+			IP:          ip,
+			Record:      rec,
+			ModRevision: kv.ModRevision,
+		}
+		// 补写索引失败不影响本次查找, 下次仍会扫描
+		if _, err := s.EtcdClient.Put(ctx, entry.Key, entry.EndpointKey); err != nil {
+			log.Warnf("index unindexed endpoint key: %s failed: %v", entry.EndpointKey, err)
+		} else {
+			log.Infof("index unindexed endpoint key: %s by index key: %s", entry.EndpointKey, entry.Key)
+		}
+		results = append(results, entry)
+	}
+	return results, nil
+}
+
+// BuildIndex 为该服务已有的endpoint建立容器索引, 完成后写入标记, 之后按容器查找不再扫描endpoint.
+// 所有节点升级后由运维显式执行(neutronctl alloc index), 不在ADD、DEL中执行; 已经建立过时直接返回
+func (s *Store) BuildIndex(ctx context.Context) error {
+	markKey := GetIndexedKey(s.Service)
+	resp, err := s.EtcdClient.Get(ctx, markKey)
+	if err != nil {
+		return err
+	}
+	if resp.Count > 0 {
+		return nil
+	}
+
+	endpoints, err := s.listEndpoints(ctx)
+	if err != nil {
+		return err
+	}
+
+	ops := make([]clientv3.Op, 0, indexBatchSize)
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		if _, err := s.EtcdClient.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return err
+		}
+		ops = ops[:0]
+		return nil
+	}
+	for _, ep := range endpoints {
+		// 粘性保留的记录不属于任何容器
+		if ep.Record.Held() {
+			continue
+		}
+		key := getIndexKey(ep.Record.ContainerID, ep.Record.IfName, ep.IP)
+		ops = append(ops, clientv3.OpPut(key, ep.Key))
+		if len(ops) == indexBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	if _, err := s.EtcdClient.Put(ctx, markKey, "1"); err != nil {
+		return err
+	}
+	s.indexed = true
+	log.Infof("build container index for service: %s with %d endpoints success", s.Service, len(endpoints))
+	return nil
+}
@@ -14,16 +14,66 @@
 
 package etcd
 
-import "net"
+import (
+	"context"
+	"net"
+	"time"
+)
 
+// Storager 按服务维度的ip存储接口, allocator只依赖该接口.
+// 实现: etcd(默认)、本地文件(disk)、内存(memory).
+// 访问存储的方法都带ctx, ctx到期或取消后立即返回错误; Unlock、Close不受ctx影响, 保证失败时也能释放锁
 type Storager interface {
-	Lock() error
+	Lock(ctx context.Context) error
 	Unlock() error
 	Close() error
-	Reserve(id string, ifname string, ip net.IP, rangeID string) (bool, error)
-	LastReservedIP(rangeID string) (net.IP, error)
-	Release(ip net.IP) error
-	ReleaseByID(id string, ifname string) error
-	GetByID(id string, ifname string) []net.IP
-	IsIPExist(ip net.IP) bool
+	Reserve(ctx context.Context, rec *Record, ip net.IP) (bool, error)
+	LastReservedIP(ctx context.Context, rangeID string) (net.IP, error)
+	Release(ctx context.Context, ip net.IP) error
+	ReleaseByID(ctx context.Context, id string, ifname string) error
+	// ReleaseExcept 释放(container id, ifname)除keep以外的ip, 用于ADD失败回滚
+	ReleaseExcept(ctx context.Context, id string, ifname string, keep []net.IP) error
+	GetByID(ctx context.Context, id string, ifname string) ([]net.IP, error)
+	FindByID(ctx context.Context, id string, ifname string) (bool, error)
+	GetAllEndpoins(ctx context.Context) ([]net.IP, error)
+	ListAllocations(ctx context.Context) ([]Allocation, error)
+
+	// 粘性ip: Hold释放(container id, ifname)的ip, 带Identity的记录保留grace时间后才真正释放;
+	// GetHeld返回为identity保留且未过期的ip; Reclaim将保留的ip重新分配给rec, ip已不再保留时返回false
+	Hold(ctx context.Context, id string, ifname string, grace time.Duration) error
+	GetHeld(ctx context.Context, identity string) ([]net.IP, error)
+	Reclaim(ctx context.Context, rec *Record, ip net.IP) (bool, error)
+
+	// 冷却: SetCooldown之后释放的ip在cooldown时间内放在冷却区, GetCooling返回仍在冷却的ip,
+	// RangeIter遍历时跳过, 避免对端残留的arp/conntrack/dns把流量转发给新的pod
+	SetCooldown(cooldown time.Duration)
+	GetCooling(ctx context.Context) ([]net.IP, error)
+
+	// GetLastHosts 返回ip -> 最后一次分配该ip的主机, 供hostAffinity策略使用
+	GetLastHosts(ctx context.Context) (map[string]string, error)
+
+	// 按块分配: LockHost只锁当前主机, 代替Lock; GetBlocks返回块(cidr) -> 申领的主机;
+	// ClaimBlock申领空闲的块, 已被申领时返回false; ReleaseBlock归还host持有的块;
+	// BlockInUse只检查该块内是否还有分配记录(包括粘性保留), 释放ip后用来判断块能否归还
+	LockHost(ctx context.Context) error
+	GetBlocks(ctx context.Context) (map[string]string, error)
+	ClaimBlock(ctx context.Context, block *net.IPNet, host string) (bool, error)
+	ReleaseBlock(ctx context.Context, block *net.IPNet, host string) error
+	BlockInUse(ctx context.Context, block *net.IPNet) (bool, error)
+}
+
+// Allocation 已分配的ip及其分配记录
+type Allocation struct {
+	IP     net.IP
+	Record *Record
+}
+
+// ContainsIP ips中是否有ip
+func ContainsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
 }
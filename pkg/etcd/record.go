@@ -0,0 +1,97 @@
+// copyright @ 2020 ops inc.
+
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RECORD_VERSION 当前endpoint记录的格式版本; 旧格式(host:id:pod)视为版本0
+const RECORD_VERSION = 1
+
+// Record 每个已分配ip对应的分配记录, 以json保存在endpoint key中
+type Record struct {
+	Version      int       `json:"version"`
+	ContainerID  string    `json:"containerID"`
+	IfName       string    `json:"ifname"`
+	Netns        string    `json:"netns,omitempty"`
+	PodNamespace string    `json:"podNamespace,omitempty"`
+	PodName      string    `json:"podName,omitempty"`
+	Host         string    `json:"host"`
+	AllocatedAt  time.Time `json:"allocatedAt"`
+	RangeID      string    `json:"rangeID"`
+
+	// 粘性ip: Identity为pod的稳定身份; DEL后记录不删除, 清空容器信息并保留到HeldUntil
+	Identity  string     `json:"identity,omitempty"`
+	HeldUntil *time.Time `json:"heldUntil,omitempty"`
+}
+
+// Match 判断记录是否属于(container id, ifname); 旧格式迁移来的记录没有ifname, 只按container id匹配
+func (r *Record) Match(id, ifname string) bool {
+	if r.ContainerID != id {
+		return false
+	}
+	return r.IfName == "" || r.IfName == ifname
+}
+
+// Held 是否为DEL后为Identity保留的记录
+func (r *Record) Held() bool {
+	return r.HeldUntil != nil
+}
+
+// Expired 保留的记录是否已过期; etcd中由租约自动删除, disk/memory存储需自行判断
+func (r *Record) Expired(now time.Time) bool {
+	return r.Held() && now.After(*r.HeldUntil)
+}
+
+// Hold 生成为Identity保留到until的记录, 不再属于任何容器
+func (r *Record) Hold(until time.Time) *Record {
+	rec := *r
+	rec.ContainerID = ""
+	rec.IfName = ""
+	rec.Netns = ""
+	rec.HeldUntil = &until
+	return &rec
+}
+
+// Legacy 是否为旧格式迁移过来的记录
+func (r *Record) Legacy() bool {
+	return r.Version < RECORD_VERSION
+}
+
+func (r *Record) Marshal() ([]byte, error) {
+	return json.Marshal(r)
+}
+
+// ParseRecord 解析endpoint值, 兼容旧格式: hostname:containerID:podname
+func ParseRecord(data []byte) (*Record, error) {
+	val := strings.TrimSpace(string(data))
+	if strings.HasPrefix(val, "{") {
+		var rec Record
+		if err := json.Unmarshal([]byte(val), &rec); err != nil {
+			return nil, fmt.Errorf("invalid endpoint record %q: %v", val, err)
+		}
+		return &rec, nil
+	}
+
+	valList := strings.Split(val, ":")
+	if len(valList) != 3 {
+		return nil, fmt.Errorf("invalid endpoint record %q", val)
+	}
+	return &Record{
+		Version:     0,
+		Host:        valList[0],
+		ContainerID: valList[1],
+		PodName:     valList[2],
+	}, nil
+}
+
+// Migrate 将旧格式记录升级为当前版本
+func (r *Record) Migrate() *Record {
+	rec := *r
+	rec.Version = RECORD_VERSION
+	return &rec
+}
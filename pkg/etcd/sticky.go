@@ -0,0 +1,148 @@
+// copyright @ 2020 ops inc.
+
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"neutron/pkg/log"
+)
+
+func getStickyIndexKey(service, identity string, ip net.IP) string {
+	return fmt.Sprintf("%s/%s", GetStickyKey(service, identity), ip.String())
+}
+
+// leaseTTL 租约以秒为单位, 不足1秒的部分向上取整, 避免不足1秒的grace得到ttl 0
+func leaseTTL(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// Hold 带Identity的记录改为保留状态: endpoint和粘性索引绑定同一个租约, grace后由etcd自动删除;
+// 没有Identity的记录直接释放
+func (s *Store) Hold(ctx context.Context, id string, ifname string, grace time.Duration) error {
+	entries, err := s.getIndex(ctx, id, ifname)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Record == nil || entry.Record.Identity == "" || grace <= 0 {
+			if err := s.releaseEntry(ctx, entry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		lease, err := s.EtcdClient.Grant(ctx, leaseTTL(grace))
+		if err != nil {
+			return fmt.Errorf("grant lease for endpoint key: %s failed: %v", entry.EndpointKey, err)
+		}
+		// 没有写入时撤销租约
+		leaseDesc := "hold lease for endpoint key: " + entry.EndpointKey
+		rec := entry.Record.Hold(time.Now().Add(grace))
+		value, err := rec.Marshal()
+		if err != nil {
+			s.revokeLease(lease.ID, leaseDesc)
+			return err
+		}
+		stickyKey := getStickyIndexKey(s.Service, rec.Identity, entry.IP)
+
+		// endpoint在读取后被修改过则放弃
+		txnResp, err := s.EtcdClient.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(entry.EndpointKey), "=", entry.ModRevision)).
+			Then(
+				clientv3.OpPut(entry.EndpointKey, string(value), clientv3.WithLease(lease.ID)),
+				clientv3.OpPut(stickyKey, entry.EndpointKey, clientv3.WithLease(lease.ID)),
+				clientv3.OpDelete(entry.Key),
+			).
+			Commit()
+		if err != nil {
+			s.revokeLease(lease.ID, leaseDesc)
+			return err
+		}
+		if !txnResp.Succeeded {
+			s.revokeLease(lease.ID, leaseDesc)
+			log.Warnf("hold endpoint key: %s skipped, it was modified concurrently", entry.EndpointKey)
+			continue
+		}
+		log.Infof("hold endpoint key: %s for identity: %s until: %s", entry.EndpointKey, rec.Identity, rec.HeldUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// GetHeld 根据粘性索引读取为identity保留的ip
+func (s *Store) GetHeld(ctx context.Context, identity string) ([]net.IP, error) {
+	prefix := GetStickyKey(s.Service, identity) + "/"
+	resp, err := s.EtcdClient.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	var results []net.IP
+	for _, kv := range resp.Kvs {
+		ip := net.ParseIP(strings.TrimPrefix(string(kv.Key), prefix))
+		if ip == nil {
+			continue
+		}
+		rec, _, err := s.getHeldRecord(ctx, string(kv.Value), identity)
+		if err != nil {
+			return nil, err
+		}
+		if rec != nil {
+			results = append(results, ip)
+		}
+	}
+	return results, nil
+}
+
+// Reclaim 将为rec.Identity保留的ip重新分配给rec: 去掉租约写回endpoint, 写入容器索引并删除粘性索引
+func (s *Store) Reclaim(ctx context.Context, rec *Record, ip net.IP) (bool, error) {
+	key := fmt.Sprintf("%s/%s", GetEndpointsKey(s.Service), ip.String())
+	held, modRevision, err := s.getHeldRecord(ctx, key, rec.Identity)
+	if err != nil || held == nil {
+		return false, err
+	}
+
+	value, err := rec.Marshal()
+	if err != nil {
+		return false, err
+	}
+	txnResp, err := s.EtcdClient.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", modRevision)).
+		Then(
+			clientv3.OpPut(key, string(value)),
+			clientv3.OpPut(getIndexKey(rec.ContainerID, rec.IfName, ip), key),
+			clientv3.OpDelete(getStickyIndexKey(s.Service, rec.Identity, ip)),
+		).
+		Commit()
+	if err != nil {
+		return false, fmt.Errorf("reclaim endpoint key: %s failed: %v", key, err)
+	}
+	if !txnResp.Succeeded {
+		log.Infof("reclaim endpoint key: %s skipped, it was modified concurrently", key)
+		return false, nil
+	}
+	log.Infof("reclaim endpoint key: %s for identity: %s container: %s success", key, rec.Identity, rec.ContainerID)
+	return true, nil
+}
+
+// getHeldRecord 读取endpoint, 仍为identity保留时返回记录及其ModRevision, 否则返回nil
+func (s *Store) getHeldRecord(ctx context.Context, key, identity string) (*Record, int64, error) {
+	resp, err := s.EtcdClient.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.Count == 0 {
+		return nil, 0, nil
+	}
+	rec, err := ParseRecord(resp.Kvs[0].Value)
+	if err != nil || !rec.Held() || rec.Identity != identity {
+		return nil, 0, nil
+	}
+	return rec, resp.Kvs[0].ModRevision, nil
+}
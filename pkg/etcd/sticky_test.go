@@ -0,0 +1,23 @@
+package etcd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLeaseTTL(t *testing.T) {
+	cases := []struct {
+		grace time.Duration
+		want  int64
+	}{
+		{time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{time.Hour, 3600},
+	}
+	for _, c := range cases {
+		if got := leaseTTL(c.grace); got != c.want {
+			t.Errorf("leaseTTL(%s) = %d, want %d", c.grace, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+// copyright @ 2020 ops inc.
+
+package etcd
+
+import (
+	"context"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"neutron/pkg/log"
+)
+
+// timeoutKV 为每次kv请求(包括事务提交)加上超时, 调用方传入的ctx仍然有效;
+// 读和幂等写(Put、Delete、无条件事务)遇到etcd短暂不可用时按退避策略重试.
+// 带条件的事务(如Reserve)第一次可能已经提交只是没有收到响应, 重试会得到错误的结果, 不重试
+type timeoutKV struct {
+	clientv3.KV
+	timeout time.Duration
+	policy  *RetryConf
+}
+
+func newTimeoutKV(kv clientv3.KV, timeout time.Duration, policy *RetryConf) clientv3.KV {
+	return &timeoutKV{KV: kv, timeout: timeout, policy: policy}
+}
+
+func (kv *timeoutKV) Put(ctx context.Context, key, val string, opts ...clientv3.OpOption) (resp *clientv3.PutResponse, err error) {
+	err = kv.do(ctx, "put "+key, true, func(ctx context.Context) error {
+		resp, err = kv.KV.Put(ctx, key, val, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (kv *timeoutKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (resp *clientv3.GetResponse, err error) {
+	err = kv.do(ctx, "get "+key, true, func(ctx context.Context) error {
+		resp, err = kv.KV.Get(ctx, key, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (kv *timeoutKV) Delete(ctx context.Context, key string, opts ...clientv3.OpOption) (resp *clientv3.DeleteResponse, err error) {
+	err = kv.do(ctx, "delete "+key, true, func(ctx context.Context) error {
+		resp, err = kv.KV.Delete(ctx, key, opts...)
+		return err
+	})
+	return resp, err
+}
+
+func (kv *timeoutKV) Do(ctx context.Context, op clientv3.Op) (resp clientv3.OpResponse, err error) {
+	err = kv.do(ctx, "do "+string(op.KeyBytes()), !op.IsTxn(), func(ctx context.Context) error {
+		resp, err = kv.KV.Do(ctx, op)
+		return err
+	})
+	return resp, err
+}
+
+// Txn 事务在Commit时才发出请求, 先记录条件和操作, Commit时再带超时创建真正的事务
+func (kv *timeoutKV) Txn(ctx context.Context) clientv3.Txn {
+	return &timeoutTxn{kv: kv, ctx: ctx}
+}
+
+type timeoutTxn struct {
+	kv      *timeoutKV
+	ctx     context.Context
+	cmps    []clientv3.Cmp
+	thenOps []clientv3.Op
+	elseOps []clientv3.Op
+}
+
+func (t *timeoutTxn) If(cs ...clientv3.Cmp) clientv3.Txn {
+	t.cmps = append(t.cmps, cs...)
+	return t
+}
+
+func (t *timeoutTxn) Then(ops ...clientv3.Op) clientv3.Txn {
+	t.thenOps = append(t.thenOps, ops...)
+	return t
+}
+
+func (t *timeoutTxn) Else(ops ...clientv3.Op) clientv3.Txn {
+	t.elseOps = append(t.elseOps, ops...)
+	return t
+}
+
+// Commit 只有无条件的事务(一组put/delete)是幂等的, 才会重试
+func (t *timeoutTxn) Commit() (resp *clientv3.TxnResponse, err error) {
+	err = t.kv.do(t.ctx, "txn", len(t.cmps) == 0, func(ctx context.Context) error {
+		resp, err = t.kv.KV.Txn(ctx).If(t.cmps...).Then(t.thenOps...).Else(t.elseOps...).Commit()
+		return err
+	})
+	return resp, err
+}
+
+// do 执行一次请求, retry为true时对可重试的错误按退避策略重试, 直到成功、次数用完或ctx到期
+func (kv *timeoutKV) do(ctx context.Context, name string, retry bool, fn func(ctx context.Context) error) error {
+	attempts := kv.policy.attempts()
+	for attempt := 1; ; attempt++ {
+		reqCtx, cancel := context.WithTimeout(ctx, kv.timeout)
+		err := fn(reqCtx)
+		cancel()
+		if err == nil || !retry || attempt >= attempts || ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+
+		delay := kv.policy.backoff(attempt)
+		log.Warnf("etcd %s failed: %v, retry %d/%d after %s", name, err, attempt, attempts-1, delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryable etcd短暂不可用(选主、网络抖动、单次请求超时)的错误可以重试
+func isRetryable(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	var code codes.Code
+	if ee, ok := err.(rpctypes.EtcdError); ok {
+		code = ee.Code()
+	} else if s, ok := status.FromError(err); ok {
+		code = s.Code()
+	} else {
+		return false
+	}
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
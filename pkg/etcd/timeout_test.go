@@ -0,0 +1,168 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"neutron/pkg/log"
+)
+
+func TestMain(m *testing.M) {
+	log.InitCliLogger()
+	os.Exit(m.Run())
+}
+
+func TestRetryConfDefaults(t *testing.T) {
+	var r *RetryConf
+	if got := r.attempts(); got != DEFAULT_RETRY_ATTEMPTS {
+		t.Errorf("nil attempts = %d, want %d", got, DEFAULT_RETRY_ATTEMPTS)
+	}
+	if got := (&RetryConf{MaxAttempts: 1}).attempts(); got != 1 {
+		t.Errorf("attempts = %d, want 1", got)
+	}
+	for attempt := 1; attempt < 10; attempt++ {
+		if d := r.backoff(attempt); d > DEFAULT_RETRY_MAX_DELAY {
+			t.Errorf("default backoff(%d) = %s, over %s", attempt, d, DEFAULT_RETRY_MAX_DELAY)
+		}
+	}
+}
+
+func TestRetryConfBackoff(t *testing.T) {
+	r := &RetryConf{BaseDelay: 100, MaxDelay: 1000}
+	tests := []struct {
+		attempt int
+		max     time.Duration // 退避上限d, 实际等待在[d/2, d]之间
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second}, // 1600ms超过maxDelay
+		{30, time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := r.backoff(tt.attempt); d < tt.max/2 || d > tt.max {
+				t.Fatalf("backoff(%d) = %s, want in [%s, %s]", tt.attempt, d, tt.max/2, tt.max)
+			}
+		}
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{context.DeadlineExceeded, true},
+		{status.Error(codes.Unavailable, "unavailable"), true},
+		{status.Error(codes.DeadlineExceeded, "deadline"), true},
+		{rpctypes.ErrNoLeader, true},
+		{context.Canceled, false},
+		{rpctypes.ErrCompacted, false},
+		{status.Error(codes.InvalidArgument, "invalid"), false},
+		{errors.New("other"), false},
+	}
+	for _, tt := range tests {
+		if got := isRetryable(tt.err); got != tt.want {
+			t.Errorf("isRetryable(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
+
+// unavailableKV 每次请求都返回Unavailable, 记录请求次数
+type unavailableKV struct {
+	clientv3.KV
+	calls int
+}
+
+func (kv *unavailableKV) Get(ctx context.Context, key string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	kv.calls++
+	return nil, status.Error(codes.Unavailable, "unavailable")
+}
+
+func (kv *unavailableKV) Do(ctx context.Context, op clientv3.Op) (clientv3.OpResponse, error) {
+	kv.calls++
+	return clientv3.OpResponse{}, status.Error(codes.Unavailable, "unavailable")
+}
+
+func (kv *unavailableKV) Txn(ctx context.Context) clientv3.Txn {
+	return &unavailableTxn{kv: kv}
+}
+
+type unavailableTxn struct {
+	kv *unavailableKV
+}
+
+func (t *unavailableTxn) If(cs ...clientv3.Cmp) clientv3.Txn   { return t }
+func (t *unavailableTxn) Then(ops ...clientv3.Op) clientv3.Txn { return t }
+func (t *unavailableTxn) Else(ops ...clientv3.Op) clientv3.Txn { return t }
+
+func (t *unavailableTxn) Commit() (*clientv3.TxnResponse, error) {
+	t.kv.calls++
+	return nil, status.Error(codes.Unavailable, "unavailable")
+}
+
+func TestTimeoutKVRetry(t *testing.T) {
+	policy := &RetryConf{MaxAttempts: 3, BaseDelay: 1, MaxDelay: 2}
+	cmp := clientv3.Compare(clientv3.Version("k"), "=", 0)
+	tests := []struct {
+		name string
+		req  func(kv clientv3.KV) error
+		want int // 请求次数
+	}{
+		{"get", func(kv clientv3.KV) error {
+			_, err := kv.Get(context.Background(), "k")
+			return err
+		}, 3},
+		{"unconditional txn", func(kv clientv3.KV) error {
+			_, err := kv.Txn(context.Background()).Then(clientv3.OpDelete("k")).Commit()
+			return err
+		}, 3},
+		{"do get", func(kv clientv3.KV) error {
+			_, err := kv.Do(context.Background(), clientv3.OpGet("k"))
+			return err
+		}, 3},
+		{"do txn", func(kv clientv3.KV) error {
+			_, err := kv.Do(context.Background(), clientv3.OpTxn([]clientv3.Cmp{cmp}, []clientv3.Op{clientv3.OpPut("k", "v")}, nil))
+			return err
+		}, 1},
+		// 第一次可能已经提交, 重试会得到错误的结果
+		{"conditional txn", func(kv clientv3.KV) error {
+			_, err := kv.Txn(context.Background()).If(cmp).Then(clientv3.OpPut("k", "v")).Commit()
+			return err
+		}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &unavailableKV{}
+			if err := tt.req(newTimeoutKV(fake, time.Second, policy)); err == nil {
+				t.Fatal("request succeeded")
+			}
+			if fake.calls != tt.want {
+				t.Errorf("calls = %d, want %d", fake.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeoutKVStopsWhenCanceled(t *testing.T) {
+	fake := &unavailableKV{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	kv := newTimeoutKV(fake, time.Second, &RetryConf{MaxAttempts: 3, BaseDelay: 1, MaxDelay: 2})
+	if _, err := kv.Get(ctx, "k"); err == nil {
+		t.Fatal("request succeeded")
+	}
+	if fake.calls != 1 {
+		t.Errorf("calls = %d after ctx canceled, want 1", fake.calls)
+	}
+}
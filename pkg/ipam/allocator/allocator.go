@@ -15,14 +15,14 @@
 package allocator
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
-	"regexp"
 	"strconv"
-	"strings"
+	"time"
 
-	"github.com/containernetworking/cni/pkg/types/current"
+	current "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/plugins/pkg/ip"
 
 	"neutron/pkg/config"
@@ -30,102 +30,110 @@ import (
 	"neutron/pkg/log"
 )
 
-func NewIPAllocator(s *config.RangeSet, store etcd.Storager, id int) *IPAllocator {
+func NewIPAllocator(s *config.RangeSet, store etcd.Storager, id int, strategy string, blockSize int) *IPAllocator {
 	return &IPAllocator{
-		rangeset: s,
-		store:    store,
-		rangeID:  strconv.Itoa(id),
+		rangeset:  s,
+		store:     store,
+		rangeID:   strconv.Itoa(id),
+		strategy:  strategy,
+		blockSize: blockSize,
 	}
 }
 
 type IPAllocator struct {
-	rangeset *config.RangeSet
-	store    etcd.Storager
-	rangeID  string // Used for tracking last reserved ip
+	rangeset  *config.RangeSet
+	store     etcd.Storager
+	rangeID   string // Used for tracking last reserved ip
+	strategy  string // 分配策略, 默认round-robin
+	blockSize int    // 按块分配时块的掩码长度, 0表示不按块分配
 }
 
-// 获取当前发布阶段: 沙盒、全流量 如: K8S_POD_NAME=pay-10-online-84f8cc5d4b-8v4fw
-func (a *IPAllocator) getDeployStage(envArgs string) string {
-	pairs := strings.Split(envArgs, ";")
-	for _, pair := range pairs {
-		kv := strings.Split(pair, "=")
-		keyString := kv[0]
-		valString := kv[1]
-		if keyString == "K8S_POD_NAME" {
-			reg := regexp.MustCompile(`-\d+-`)
-			nameList := reg.Split(valString, -1)
-			stageInfo := nameList[1]
-			stageList := strings.Split(stageInfo, "-")
-			stage := stageList[0]
-			log.Infof("Get deploy stage is: %s", stage)
-			return stage
-		}
+// Get allocates an IP, owner为该容器的分配记录(container id、ifname、pod等),
+// stage为当前的发布阶段(沙盒、全流量), 为空时从default池或不属于任何池的ip中分配.
+// 复用该容器已有的分配时reused为true, 该ip不是本次分配的, ADD失败时不能释放
+func (a *IPAllocator) Get(ctx context.Context, owner *etcd.Record, stage string, requestedIP net.IP) (*current.IPConfig, bool, error) {
+	if err := a.lock(ctx); err != nil {
+		return nil, false, err
 	}
-	return ""
-}
+	defer a.unlock()
 
-// Get allocates an IP
-func (a *IPAllocator) Get(id string, ifname string, envArgs string, requestedIP net.IP) (*current.IPConfig, error) {
-	a.store.Lock()
-	defer a.store.Unlock()
-
-	// 获取当前的分级发布阶段
-	stage := a.getDeployStage(envArgs)
-	if stage == "" {
-		return nil, fmt.Errorf("Parse deploy stage is empty.")
-	}
 	log.Infof("Get allocates current deploy stage: %s", stage)
 
 	var reservedIP *net.IPNet
 	var gw net.IP
 
+	id := owner.ContainerID
+	rec := *owner
+	rec.Version = etcd.RECORD_VERSION
+	rec.RangeID = a.rangeID
+	rec.AllocatedAt = time.Now()
+
 	log.Infof("Get allocates current requestedIP value: %s", requestedIP) // <nil>
 	if requestedIP != nil {
-		log.Infof("Get allocates requestedIP != nil")
 		if err := config.CanonicalizeIP(&requestedIP); err != nil {
-			return nil, err
+			return nil, false, err
 		}
+	}
 
+	// 运行时重试ADD时, 该容器(container id, ifname)在本range set内已有分配, 直接复用,
+	// 保证重试的sandbox拿到相同的ip
+	existing, err := a.getExisting(ctx, id, owner.IfName, requestedIP)
+	if err != nil || existing != nil {
+		return existing, existing != nil, err
+	}
+
+	// 粘性ip: 该pod身份在本range set内有保留的ip时(可能来自其他主机), 重新分配给当前容器
+	if rec.Identity != "" {
+		held, err := a.reclaimHeld(ctx, &rec, requestedIP)
+		if err != nil || held != nil {
+			return held, false, err
+		}
+	}
+
+	if requestedIP != nil {
+		log.Infof("Get allocates requestedIP != nil")
 		r, err := a.rangeset.RangeFor(requestedIP)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		log.Infof("Get allocates range: %+v for requestedIP: %v", r, requestedIP)
 
 		if requestedIP.Equal(r.Gateway) {
-			return nil, fmt.Errorf("requested ip %s is subnet's gateway", requestedIP.String())
+			return nil, false, fmt.Errorf("requested ip %s is subnet's gateway", requestedIP.String())
 		}
 
-		reserved, err := a.store.Reserve(id, ifname, requestedIP, a.rangeID)
+		reserved, err := a.store.Reserve(ctx, &rec, requestedIP)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
 		log.Infof("Get allocates reserve on etcd result: %+v", reserved)
 		if !reserved {
-			return nil, fmt.Errorf("requested IP address %s is not available in range set %s", requestedIP, a.rangeset.String())
+			return nil, false, fmt.Errorf("requested IP address %s is not available in range set %s", requestedIP, a.rangeset.String())
 		}
 		reservedIP = &net.IPNet{IP: requestedIP, Mask: r.Subnet.Mask}
 		gw = r.Gateway
 
 	} else {
 		log.Infof("Get allocates requestedIP == nil")
-		// try to get allocated IPs for this given id, if exists, just return error
-		// because duplicate allocation is not allowed in SPEC
-		// https://github.com/containernetworking/cni/blob/master/SPEC.md
-		allocatedIPs := a.store.GetByID(id, ifname)
-		for _, allocatedIP := range allocatedIPs {
-			// check whether the existing IP belong to this range set
-			if _, err := a.rangeset.RangeFor(allocatedIP); err == nil {
-				return nil, fmt.Errorf("%s has been allocated to %s, duplicate allocation is not allowed", allocatedIP.String(), id)
+		// 持有锁后一次性加载已分配的ip, 遍历时直接跳过
+		used, err := a.loadUsed(ctx)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if a.blockSize > 0 {
+			ipConf, err := a.getFromBlocks(ctx, &rec, stage, used)
+			if err != nil || ipConf != nil {
+				return ipConf, false, err
 			}
+			log.Infof("Get allocates no free block for host: %s, borrow ip from range set", rec.Host)
 		}
-		log.Infof("Get allocates check container id: %s not duplicate allocation", id)
 
-		iter, err := a.GetIter()
+		iter, err := a.newIterator(ctx, used, rec.Host)
 		if err != nil {
-			return nil, err
+			return nil, false, err
 		}
-		log.Infof("Get allocates get iter: %+v", *iter)
+		log.Infof("Get allocates strategy: %s", a.strategy)
 
 		for {
 			reservedIP, gw = iter.Next()
@@ -134,43 +142,198 @@ func (a *IPAllocator) Get(id string, ifname string, envArgs string, requestedIP
 			}
 			log.Infof("Get allocates current stage: %s fetch ip: %+v will to match", stage, reservedIP)
 
-			// NOTE: 判断当前获取到的ip, 是否匹配当前的分级发布阶段; 同时不在已分配的ip列表里
-			if iter.matchDeployStageIP(stage, reservedIP.IP) && !a.store.IsIPExist(reservedIP.IP) {
+			// NOTE: 判断当前获取到的ip, 是否匹配当前的分级发布阶段; 已分配的ip在遍历时已跳过
+			if iter.Range().MatchStage(stage, reservedIP.IP) {
 				log.Infof("Stage: %s reserved ip: %s is matched", stage, reservedIP.IP)
-				reserved, err := a.store.Reserve(id, ifname, reservedIP.IP, a.rangeID)
+				reserved, err := a.store.Reserve(ctx, &rec, reservedIP.IP)
 				if err != nil {
-					return nil, err
+					return nil, false, err
 				}
 				log.Infof("Stage: %s reserved ip: %s reserved: %t", stage, reservedIP.IP, reserved)
 
 				if reserved {
 					break
 				}
+				used.Add(reservedIP.IP)
 			}
 		}
 	}
 
 	if reservedIP == nil {
-		return nil, fmt.Errorf("no IP addresses available in range set: %s", a.rangeset.String())
-	}
-	version := "4"
-	if reservedIP.IP.To4() == nil {
-		version = "6"
+		return nil, false, fmt.Errorf("no IP addresses available in range set: %s", a.rangeset.String())
 	}
-
 	return &current.IPConfig{
-		Version: version,
 		Address: *reservedIP,
 		Gateway: gw,
-	}, nil
+	}, false, nil
+}
+
+// getExisting 返回该容器在本range set内已分配的ip, 没有时返回nil.
+// 已分配的ip与请求的ip不一致时返回错误
+func (a *IPAllocator) getExisting(ctx context.Context, id, ifname string, requestedIP net.IP) (*current.IPConfig, error) {
+	// 读取失败不能当作没有分配过, 否则重试的ADD会再分配一个ip
+	allocatedIPs, err := a.store.GetByID(ctx, id, ifname)
+	if err != nil {
+		return nil, err
+	}
+	for _, allocatedIP := range allocatedIPs {
+		// check whether the existing IP belong to this range set
+		r, err := a.rangeset.RangeFor(allocatedIP)
+		if err != nil {
+			continue
+		}
+		if requestedIP != nil && !requestedIP.Equal(allocatedIP) {
+			return nil, fmt.Errorf("%s has been allocated to %s, can not allocate requested ip %s", allocatedIP, id, requestedIP)
+		}
+		log.Infof("Get allocates container id: %s ifname: %s reuse allocated ip: %s", id, ifname, allocatedIP)
+		return &current.IPConfig{
+			Address: net.IPNet{IP: allocatedIP, Mask: r.Subnet.Mask},
+			Gateway: r.Gateway,
+		}, nil
+	}
+	return nil, nil
+}
+
+// reclaimHeld 取回为rec.Identity保留的ip, 没有时返回nil
+func (a *IPAllocator) reclaimHeld(ctx context.Context, rec *etcd.Record, requestedIP net.IP) (*current.IPConfig, error) {
+	heldIPs, err := a.store.GetHeld(ctx, rec.Identity)
+	if err != nil {
+		return nil, err
+	}
+	for _, heldIP := range heldIPs {
+		r, err := a.rangeset.RangeFor(heldIP)
+		if err != nil {
+			continue
+		}
+		if requestedIP != nil && !requestedIP.Equal(heldIP) {
+			continue
+		}
+		reclaimed, err := a.store.Reclaim(ctx, rec, heldIP)
+		if err != nil {
+			return nil, err
+		}
+		if !reclaimed {
+			continue
+		}
+		log.Infof("Get allocates identity: %s reclaim held ip: %s", rec.Identity, heldIP)
+		return &current.IPConfig{
+			Address: net.IPNet{IP: heldIP, Mask: r.Subnet.Mask},
+			Gateway: r.Gateway,
+		}, nil
+	}
+	return nil, nil
+}
+
+// Hold 粘性ip: 释放容器的ip, 带pod身份的记录保留grace时间
+func (a *IPAllocator) Hold(ctx context.Context, id string, ifname string, grace time.Duration) error {
+	if err := a.lock(ctx); err != nil {
+		return err
+	}
+	defer a.unlock()
+
+	released := a.releasing(ctx, id, ifname, nil)
+	if err := a.store.Hold(ctx, id, ifname, grace); err != nil {
+		return err
+	}
+	a.releaseEmptyBlocks(ctx, released)
+	return nil
 }
 
 // Release clears all IPs allocated for the container with given ID
-func (a *IPAllocator) Release(id string, ifname string) error {
-	a.store.Lock()
-	defer a.store.Unlock()
+func (a *IPAllocator) Release(ctx context.Context, id string, ifname string) error {
+	if err := a.lock(ctx); err != nil {
+		return err
+	}
+	defer a.unlock()
+
+	released := a.releasing(ctx, id, ifname, nil)
+	if err := a.store.ReleaseByID(ctx, id, ifname); err != nil {
+		return err
+	}
+	a.releaseEmptyBlocks(ctx, released)
+	return nil
+}
 
-	return a.store.ReleaseByID(id, ifname)
+// ReleaseExcept ADD失败回滚: 释放容器除keep以外的ip, keep为本次ADD之前已分配的ip.
+// 不按本次分配到的ip释放, 超时但已写入的ip调用方不知道, 也需要回滚
+func (a *IPAllocator) ReleaseExcept(ctx context.Context, id string, ifname string, keep []net.IP) error {
+	if err := a.lock(ctx); err != nil {
+		return err
+	}
+	defer a.unlock()
+
+	released := a.releasing(ctx, id, ifname, keep)
+	if err := a.store.ReleaseExcept(ctx, id, ifname, keep); err != nil {
+		return err
+	}
+	a.releaseEmptyBlocks(ctx, released)
+	return nil
+}
+
+// releasing 按块分配时, 释放之前记下容器将要释放的ip, 释放后只检查这些ip所在的块
+func (a *IPAllocator) releasing(ctx context.Context, id string, ifname string, keep []net.IP) []net.IP {
+	if a.blockSize <= 0 {
+		return nil
+	}
+	ips, err := a.store.GetByID(ctx, id, ifname)
+	if err != nil {
+		// 只影响空块的归还, gc时再处理
+		log.Warnf("Get ips of container id: %s failed, skip releasing empty blocks: %v", id, err)
+		return nil
+	}
+	var released []net.IP
+	for _, ip := range ips {
+		if !etcd.ContainsIP(keep, ip) {
+			released = append(released, ip)
+		}
+	}
+	return released
+}
+
+// releaseEmptyBlocks 按块分配时, 释放ip后归还本机已空的块; 只检查released所在的块, 不扫描整个服务的ip
+func (a *IPAllocator) releaseEmptyBlocks(ctx context.Context, released []net.IP) {
+	if a.blockSize <= 0 || len(released) == 0 {
+		return
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnf("Get hostname failed: %v", err)
+		return
+	}
+	releaseBlocks(ctx, a.store, hostname, released)
+}
+
+// loadUsed 从存储中加载当前服务已分配的ip, 以及仍在冷却的ip
+func (a *IPAllocator) loadUsed(ctx context.Context) (*usedSet, error) {
+	ips, err := a.store.GetAllEndpoins(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cooling, err := a.store.GetCooling(ctx)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Get allocates load %d used ips, %d cooling ips", len(ips), len(cooling))
+	return newUsedSet(a.rangeset, append(ips, cooling...)), nil
+}
+
+// lock 按块分配时只锁当前主机, 不同主机并发分配; 否则锁整个服务
+func (a *IPAllocator) lock(ctx context.Context) error {
+	lock := a.store.Lock
+	if a.blockSize > 0 {
+		lock = a.store.LockHost
+	}
+	if err := lock(ctx); err != nil {
+		return fmt.Errorf("failed to lock ip store: %v", err)
+	}
+	return nil
+}
+
+// unlock 释放锁失败时锁会随租约过期, 这里只记录日志
+func (a *IPAllocator) unlock() {
+	if err := a.store.Unlock(); err != nil {
+		log.Warnf("Unlock ip store failed: %v", err)
+	}
 }
 
 type RangeIter struct {
@@ -185,15 +348,18 @@ type RangeIter struct {
 	// The IP and range index where we started iterating; if we hit this again, we're done.
 	startIP    net.IP
 	startRange int
+
+	// Already allocated IPs, skipped by Next()
+	used *usedSet
 }
 
-// GetIter encapsulates the strategy for this allocator.
+// GetIter encapsulates the round-robin strategy for this allocator.
 // We use a round-robin strategy, attempting to evenly use the whole set.
 // More specifically, a crash-looping container will not see the same IP until
 // the entire range has been run through.
-// We may wish to consider avoiding recently-released IPs in the future.
+// Recently-released IPs are avoided: they stay in cooldown and are skipped as used.
 // 获取该rangeID下的遍历的起始ip、索引id
-func (a *IPAllocator) GetIter() (*RangeIter, error) {
+func (a *IPAllocator) GetIter(ctx context.Context) (*RangeIter, error) {
 	iter := RangeIter{
 		rangeset: a.rangeset,
 	}
@@ -203,7 +369,7 @@ func (a *IPAllocator) GetIter() (*RangeIter, error) {
 
 	// We might get a last reserved IP that is wrong if the range indexes changed.
 	// This is not critical, we just lose round-robin this one time.
-	lastReservedIP, err := a.store.LastReservedIP(a.rangeID)
+	lastReservedIP, err := a.store.LastReservedIP(ctx, a.rangeID)
 	if err != nil && !os.IsNotExist(err) {
 		log.Infof("Error retrieving last reserved ip: %v", err)
 	} else if lastReservedIP != nil {
@@ -232,9 +398,19 @@ func (a *IPAllocator) GetIter() (*RangeIter, error) {
 	return &iter, nil
 }
 
-// Next returns the next IP, its mask, and its gateway. Returns nil
+// Next returns the next free IP, its mask, and its gateway. Returns nil
 // if the iterator has been exhausted
 func (i *RangeIter) Next() (*net.IPNet, net.IP) {
+	for {
+		ipn, gw := i.next()
+		if ipn == nil || i.used == nil || !i.used.Contains(i.rangeIdx, ipn.IP) {
+			return ipn, gw
+		}
+	}
+}
+
+// next returns the next IP in the range set, including already allocated ones
+func (i *RangeIter) next() (*net.IPNet, net.IP) {
 	r := (*i.rangeset)[i.rangeIdx]
 
 	// If this is the first time iterating and we're not starting in the middle
@@ -243,7 +419,7 @@ func (i *RangeIter) Next() (*net.IPNet, net.IP) {
 		i.cur = r.RangeStart
 		i.startIP = i.cur
 		if i.cur.Equal(r.Gateway) {
-			return i.Next()
+			return i.next()
 		}
 		return &net.IPNet{IP: i.cur, Mask: r.Subnet.Mask}, r.Gateway
 	}
@@ -268,39 +444,13 @@ func (i *RangeIter) Next() (*net.IPNet, net.IP) {
 	}
 
 	if i.cur.Equal(r.Gateway) {
-		return i.Next()
+		return i.next()
 	}
 
 	return &net.IPNet{IP: i.cur, Mask: r.Subnet.Mask}, r.Gateway
 }
 
-// 判断当前发布阶段, 获取的ip是否是在对应的列表里
-func (i *RangeIter) matchDeployStageIP(stage string, ip net.IP) bool {
-	r := (*i.rangeset)[i.rangeIdx]
-	sandboxList := r.Sandbox
-	if stage == "sandbox" {
-		if i.in(ip, sandboxList) {
-			return true
-		}
-	} else {
-		// 全流量阶段, 如果获取到的ip是属于沙盒、小流量的应该返回false
-		if i.in(ip, sandboxList) {
-			return false
-		}
-		return true
-	}
-	return false
-}
-
-// 判断一个ip是否在一个ip列表里
-func (i *RangeIter) in(ip net.IP, ipList []net.IP) bool {
-	if ip == nil || len(ipList) == 0 {
-		return false
-	}
-	for _, curIp := range ipList {
-		if ip.Equal(curIp) {
-			return true
-		}
-	}
-	return false
+// Range 当前遍历到的range
+func (i *RangeIter) Range() *config.Range {
+	return &(*i.rangeset)[i.rangeIdx]
 }
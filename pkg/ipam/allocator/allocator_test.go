@@ -0,0 +1,168 @@
+package allocator
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"neutron/pkg/config"
+	"neutron/pkg/etcd"
+	"neutron/pkg/log"
+	"neutron/pkg/store"
+)
+
+func TestMain(m *testing.M) {
+	log.InitCliLogger()
+	os.Exit(m.Run())
+}
+
+func newRangeSet(t *testing.T, subnets ...string) *config.RangeSet {
+	t.Helper()
+	var rs config.RangeSet
+	for _, subnet := range subnets {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs = append(rs, config.Range{Subnet: types.IPNet(*n)})
+	}
+	if err := rs.Canonicalize(); err != nil {
+		t.Fatal(err)
+	}
+	return &rs
+}
+
+func openStore(t *testing.T) etcd.Storager {
+	t.Helper()
+	s, err := store.NewMemory().Open(context.Background(), "svc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func owner(id, host string) *etcd.Record {
+	return &etcd.Record{ContainerID: id, IfName: "eth0", Host: host}
+}
+
+func mustGet(t *testing.T, a *IPAllocator, rec *etcd.Record) string {
+	t.Helper()
+	ipConf, _, err := a.Get(context.Background(), rec, "", nil)
+	if err != nil {
+		t.Fatalf("get ip for %s: %v", rec.ContainerID, err)
+	}
+	return ipConf.Address.IP.String()
+}
+
+func mustRelease(t *testing.T, a *IPAllocator, id string) {
+	t.Helper()
+	if err := a.Release(context.Background(), id, "eth0"); err != nil {
+		t.Fatalf("release %s: %v", id, err)
+	}
+}
+
+func TestAllocateFromMemoryStore(t *testing.T) {
+	// 10.0.0.0/29: 网关.1, 可分配.2-.6
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), openStore(t), 0, "", 0)
+	for i, id := range []string{"a", "b", "c", "d", "e"} {
+		want := net.IPv4(10, 0, 0, byte(i+2)).String()
+		if got := mustGet(t, a, owner(id, "h1")); got != want {
+			t.Errorf("%s got %s, want %s", id, got, want)
+		}
+	}
+	if _, _, err := a.Get(context.Background(), owner("f", "h1"), "", nil); err == nil {
+		t.Fatalf("allocation from a full range succeeded")
+	}
+
+	// 释放后可以再次分配
+	mustRelease(t, a, "c")
+	if got := mustGet(t, a, owner("f", "h1")); got != "10.0.0.4" {
+		t.Errorf("after release got %s, want 10.0.0.4", got)
+	}
+}
+
+func TestRequestedIP(t *testing.T) {
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), openStore(t), 0, "", 0)
+	ctx := context.Background()
+	tests := []struct {
+		id      string
+		ip      string
+		wantErr bool
+	}{
+		{id: "a", ip: "10.0.0.5"},
+		{id: "b", ip: "10.0.0.5", wantErr: true}, // 已被a使用
+		{id: "c", ip: "10.0.0.1", wantErr: true}, // 网关
+		{id: "d", ip: "10.0.9.9", wantErr: true}, // 不在range内
+	}
+	for _, tt := range tests {
+		ipConf, _, err := a.Get(ctx, owner(tt.id, "h1"), "", net.ParseIP(tt.ip))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("request %s for %s: got %v, want error", tt.ip, tt.id, ipConf.Address.IP)
+			}
+			continue
+		}
+		if err != nil || ipConf.Address.IP.String() != tt.ip {
+			t.Errorf("request %s for %s: got %v, %v", tt.ip, tt.id, ipConf, err)
+		}
+	}
+}
+
+func TestRetryReusesAllocation(t *testing.T) {
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), openStore(t), 0, "", 0)
+	ctx := context.Background()
+	first, reused, err := a.Get(ctx, owner("a", "h1"), "", nil)
+	if err != nil || reused {
+		t.Fatalf("first get: reused %t, err %v", reused, err)
+	}
+	again, reused, err := a.Get(ctx, owner("a", "h1"), "", nil)
+	if err != nil || !reused {
+		t.Fatalf("retry: reused %t, err %v", reused, err)
+	}
+	if !again.Address.IP.Equal(first.Address.IP) {
+		t.Errorf("retry got %s, want %s", again.Address.IP, first.Address.IP)
+	}
+	if _, _, err := a.Get(context.Background(), owner("a", "h1"), "", net.ParseIP("10.0.0.5")); err == nil {
+		t.Errorf("retry with a different requested ip succeeded")
+	}
+}
+
+// failingStore GetByID读取失败
+type failingStore struct {
+	etcd.Storager
+}
+
+func (s failingStore) GetByID(ctx context.Context, id string, ifname string) ([]net.IP, error) {
+	return nil, errors.New("read failed")
+}
+
+// TestGetFailsOnReadError 读取已有分配失败时不能当作没有分配, 否则重试的ADD会再分配一个ip
+func TestGetFailsOnReadError(t *testing.T) {
+	s := openStore(t)
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), s, 0, "", 0)
+	first := mustGet(t, a, owner("a", "h1"))
+
+	a = NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), failingStore{s}, 0, "", 0)
+	if ip, _, err := a.Get(context.Background(), owner("a", "h1"), "", nil); err == nil {
+		t.Fatalf("get with read error allocated %s, already has %s", ip.Address.IP, first)
+	}
+}
+
+func TestReleaseExcept(t *testing.T) {
+	s := openStore(t)
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), s, 0, "", 0)
+	ctx := context.Background()
+	kept := net.ParseIP(mustGet(t, a, owner("a", "h1")))
+	mustGet(t, NewIPAllocator(newRangeSet(t, "10.0.1.0/29"), s, 1, "", 0), owner("a", "h1"))
+	if err := a.ReleaseExcept(ctx, "a", "eth0", []net.IP{kept}); err != nil {
+		t.Fatal(err)
+	}
+	ips, err := a.store.GetByID(ctx, "a", "eth0")
+	if err != nil || len(ips) != 1 || !ips[0].Equal(kept) {
+		t.Errorf("ips after release except %s: %v, %v", kept, ips, err)
+	}
+}
@@ -0,0 +1,81 @@
+// copyright @ 2020 ops inc.
+
+package allocator
+
+import (
+	"math/big"
+	"net"
+
+	"neutron/pkg/config"
+)
+
+// rangeBitmap 记录单个range内已使用的ip, 第n位表示RangeStart+n.
+// 按64位分组稀疏存储, 大的ipv6 range也不会预先分配内存
+type rangeBitmap struct {
+	start *big.Int
+	words map[uint64]uint64
+}
+
+func newRangeBitmap(r *config.Range) *rangeBitmap {
+	return &rangeBitmap{
+		start: new(big.Int).SetBytes(r.RangeStart.To16()),
+		words: map[uint64]uint64{},
+	}
+}
+
+// offset 返回ip相对RangeStart的偏移
+func (b *rangeBitmap) offset(ip net.IP) (uint64, bool) {
+	off := new(big.Int).SetBytes(ip.To16())
+	off.Sub(off, b.start)
+	if off.Sign() < 0 || !off.IsUint64() {
+		return 0, false
+	}
+	return off.Uint64(), true
+}
+
+func (b *rangeBitmap) Set(ip net.IP) {
+	if off, ok := b.offset(ip); ok {
+		b.words[off/64] |= 1 << (off % 64)
+	}
+}
+
+func (b *rangeBitmap) Test(ip net.IP) bool {
+	off, ok := b.offset(ip)
+	if !ok {
+		return false
+	}
+	return b.words[off/64]&(1<<(off%64)) != 0
+}
+
+// usedSet 一次分配过程中使用的已分配ip集合, 每个range一个bitmap;
+// 在持有服务锁后从存储中加载一次, 由RangeIter跳过已使用的ip
+type usedSet struct {
+	rangeset *config.RangeSet
+	bitmaps  []*rangeBitmap
+}
+
+func newUsedSet(rangeset *config.RangeSet, ips []net.IP) *usedSet {
+	u := &usedSet{rangeset: rangeset}
+	for i := range *rangeset {
+		u.bitmaps = append(u.bitmaps, newRangeBitmap(&(*rangeset)[i]))
+	}
+	for _, ip := range ips {
+		u.Add(ip)
+	}
+	return u
+}
+
+// Add 标记ip已使用, 不在rangeset内的ip忽略
+func (u *usedSet) Add(ip net.IP) {
+	for i, r := range *u.rangeset {
+		if r.Contains(ip) {
+			u.bitmaps[i].Set(ip)
+			return
+		}
+	}
+}
+
+// Contains 判断第rangeIdx个range内的ip是否已使用
+func (u *usedSet) Contains(rangeIdx int, ip net.IP) bool {
+	return u.bitmaps[rangeIdx].Test(ip)
+}
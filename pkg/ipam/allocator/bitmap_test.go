@@ -0,0 +1,41 @@
+package allocator
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUsedSet(t *testing.T) {
+	rs6 := newRangeSet(t, "fd00::/64")
+	rs4 := newRangeSet(t, "10.0.0.0/24", "10.0.1.0/24")
+	used := newUsedSet(rs4, []net.IP{
+		net.ParseIP("10.0.0.5").To4(),
+		net.ParseIP("10.0.1.200").To4(),
+		net.ParseIP("192.168.0.1").To4(), // 不在range set内, 忽略
+	})
+	tests := []struct {
+		idx  int
+		ip   string
+		want bool
+	}{
+		{0, "10.0.0.5", true},
+		{0, "10.0.0.6", false},
+		{1, "10.0.1.200", true},
+		{1, "10.0.1.5", false},
+		{0, "10.0.1.200", false},
+	}
+	for _, tt := range tests {
+		if got := used.Contains(tt.idx, net.ParseIP(tt.ip).To4()); got != tt.want {
+			t.Errorf("Contains(%d, %s) = %t, want %t", tt.idx, tt.ip, got, tt.want)
+		}
+	}
+
+	// 大的ipv6 range稀疏存储
+	used6 := newUsedSet(rs6, []net.IP{net.ParseIP("fd00::ffff:1")})
+	if !used6.Contains(0, net.ParseIP("fd00::ffff:1")) || used6.Contains(0, net.ParseIP("fd00::ffff:2")) {
+		t.Errorf("ipv6 bitmap mismatch")
+	}
+	if len(used6.bitmaps[0].words) != 1 {
+		t.Errorf("ipv6 bitmap allocated %d words, want 1", len(used6.bitmaps[0].words))
+	}
+}
@@ -0,0 +1,206 @@
+// copyright @ 2020 ops inc.
+
+package allocator
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sort"
+
+	current "github.com/containernetworking/cni/pkg/types/100"
+	"github.com/containernetworking/plugins/pkg/ip"
+
+	"neutron/pkg/etcd"
+	"neutron/pkg/log"
+)
+
+// getFromBlocks 按块分配: 先从本机已申领的块中分配, 没有空闲ip时申领新的块.
+// 所有块都已被其他主机申领时返回nil, 由调用方按分配策略从整个range set中借用ip
+func (a *IPAllocator) getFromBlocks(ctx context.Context, rec *etcd.Record, stage string, used *usedSet) (*current.IPConfig, error) {
+	claimed, err := a.store.GetBlocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var owned []*net.IPNet
+	for cidr, host := range claimed {
+		if host != rec.Host {
+			continue
+		}
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil || a.blockRange(block) < 0 {
+			continue
+		}
+		owned = append(owned, block)
+	}
+	sort.Slice(owned, func(i, j int) bool {
+		return bytes.Compare(owned[i].IP.To16(), owned[j].IP.To16()) < 0
+	})
+	log.Infof("Get allocates host: %s owns %d blocks", rec.Host, len(owned))
+
+	for _, block := range owned {
+		ipConf, err := a.reserveInBlock(ctx, rec, stage, used, a.blockRange(block), block)
+		if err != nil || ipConf != nil {
+			return ipConf, err
+		}
+	}
+
+	// 本机的块已用完, 按顺序申领第一个有空闲ip的块
+	for idx := range *a.rangeset {
+		var ipConf *current.IPConfig
+		err := a.eachBlock(idx, func(block *net.IPNet) (bool, error) {
+			if _, ok := claimed[block.String()]; ok {
+				return true, nil
+			}
+			if a.firstFree(stage, used, idx, block) == nil {
+				return true, nil
+			}
+			ok, err := a.store.ClaimBlock(ctx, block, rec.Host)
+			if err != nil || !ok {
+				return err == nil, err
+			}
+			log.Infof("Get allocates host: %s claim block: %s", rec.Host, block)
+			ipConf, err = a.reserveInBlock(ctx, rec, stage, used, idx, block)
+			return err == nil && ipConf == nil, err
+		})
+		if err != nil || ipConf != nil {
+			return ipConf, err
+		}
+	}
+	return nil, nil
+}
+
+// reserveInBlock 依次预留块内的空闲ip, 块内没有空闲ip时返回nil
+func (a *IPAllocator) reserveInBlock(ctx context.Context, rec *etcd.Record, stage string, used *usedSet, idx int, block *net.IPNet) (*current.IPConfig, error) {
+	r := (*a.rangeset)[idx]
+	for {
+		freeIP := a.firstFree(stage, used, idx, block)
+		if freeIP == nil {
+			return nil, nil
+		}
+		reserved, err := a.store.Reserve(ctx, rec, freeIP)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Stage: %s reserved ip: %s in block: %s reserved: %t", stage, freeIP, block, reserved)
+		if reserved {
+			return &current.IPConfig{
+				Address: net.IPNet{IP: freeIP, Mask: r.Subnet.Mask},
+				Gateway: r.Gateway,
+			}, nil
+		}
+		used.Add(freeIP)
+	}
+}
+
+// firstFree 返回块内(与range的交集)第一个未使用、匹配发布阶段且不是网关的ip
+func (a *IPAllocator) firstFree(stage string, used *usedSet, idx int, block *net.IPNet) net.IP {
+	r := (*a.rangeset)[idx]
+	first, last := block.IP, blockLast(block)
+	if ip.Cmp(first, r.RangeStart) < 0 {
+		first = r.RangeStart
+	}
+	if ip.Cmp(last, r.RangeEnd) > 0 {
+		last = r.RangeEnd
+	}
+	for cur := first; ip.Cmp(cur, last) <= 0; cur = ip.NextIP(cur) {
+		if !cur.Equal(r.Gateway) && !used.Contains(idx, cur) && r.MatchStage(stage, cur) {
+			return cur
+		}
+		if cur.Equal(last) {
+			break
+		}
+	}
+	return nil
+}
+
+// eachBlock 按地址顺序遍历与第idx个range重叠的块, fn返回false时停止
+func (a *IPAllocator) eachBlock(idx int, fn func(block *net.IPNet) (bool, error)) error {
+	r := (*a.rangeset)[idx]
+	_, bits := r.Subnet.Mask.Size()
+	mask := net.CIDRMask(a.blockSize, bits)
+	for start := r.RangeStart.Mask(mask); ; {
+		block := &net.IPNet{IP: start, Mask: mask}
+		next, err := fn(block)
+		if err != nil || !next {
+			return err
+		}
+		last := blockLast(block)
+		if ip.Cmp(last, r.RangeEnd) >= 0 {
+			return nil
+		}
+		start = ip.NextIP(last)
+	}
+}
+
+// blockRange 返回块所属range的下标, 块不属于本range set(或块大小与配置不一致)时返回-1
+func (a *IPAllocator) blockRange(block *net.IPNet) int {
+	if ones, _ := block.Mask.Size(); ones != a.blockSize {
+		return -1
+	}
+	for idx, r := range *a.rangeset {
+		if r.Contains(block.IP) || block.Contains(r.RangeStart) {
+			return idx
+		}
+	}
+	return -1
+}
+
+// blockLast 块内最后一个地址
+func blockLast(block *net.IPNet) net.IP {
+	last := make(net.IP, len(block.IP))
+	for i := range block.IP {
+		last[i] = block.IP[i] | ^block.Mask[i]
+	}
+	return last
+}
+
+// ReleaseEmptyBlocks 归还host申领的、已没有任何分配记录(包括粘性保留)的块, 供gc使用.
+// 块只决定主机优先从哪里分配, ip的唯一性由Reserve保证, 归还失败只记录日志
+func ReleaseEmptyBlocks(ctx context.Context, store etcd.Storager, host string) {
+	releaseBlocks(ctx, store, host, nil)
+}
+
+// releaseBlocks 归还host申领的已空的块, ips不为空时只检查包含这些ip的块
+func releaseBlocks(ctx context.Context, store etcd.Storager, host string, ips []net.IP) {
+	claimed, err := store.GetBlocks(ctx)
+	if err != nil {
+		log.Warnf("Get blocks failed: %v", err)
+		return
+	}
+	for cidr, owner := range claimed {
+		if owner != host {
+			continue
+		}
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			continue
+		}
+		if ips != nil && !blockContains(block, ips) {
+			continue
+		}
+		inUse, err := store.BlockInUse(ctx, block)
+		if err != nil {
+			log.Warnf("Check block: %s failed: %v", cidr, err)
+			continue
+		}
+		if inUse {
+			continue
+		}
+		if err := store.ReleaseBlock(ctx, block, host); err != nil {
+			log.Warnf("Release empty block: %s failed: %v", cidr, err)
+			continue
+		}
+		log.Infof("Release empty block: %s of host: %s", cidr, host)
+	}
+}
+
+func blockContains(block *net.IPNet, ips []net.IP) bool {
+	for _, ip := range ips {
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
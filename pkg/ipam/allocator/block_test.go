@@ -0,0 +1,55 @@
+package allocator
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestBlocks(t *testing.T) {
+	ctx := context.Background()
+	s := openStore(t)
+	// 10.0.0.0/28按/29分为两个块: .0/29(网关.1, 可分配.2-.7)、.8/29(.8-.14)
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/28"), s, 0, "", 29)
+
+	steps := []struct {
+		id, host, want string
+	}{
+		{"a", "h1", "10.0.0.2"},  // h1申领第一个块
+		{"b", "h2", "10.0.0.8"},  // h2申领第二个块
+		{"c", "h1", "10.0.0.3"},  // h1从自己的块中分配
+		{"d", "h2", "10.0.0.9"},  // h2从自己的块中分配
+		{"e", "h3", "10.0.0.10"}, // 没有空闲的块, 按round-robin借用
+	}
+	for _, step := range steps {
+		if got := mustGet(t, a, owner(step.id, step.host)); got != step.want {
+			t.Errorf("%s on %s got %s, want %s", step.id, step.host, got, step.want)
+		}
+	}
+
+	blocks, err := s.GetBlocks(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blocks["10.0.0.0/29"] != "h1" || blocks["10.0.0.8/29"] != "h2" || len(blocks) != 2 {
+		t.Fatalf("unexpected block claims: %v", blocks)
+	}
+
+	// h2的块中还有借用的ip, 不能归还
+	mustRelease(t, a, "b")
+	mustRelease(t, a, "d")
+	ReleaseEmptyBlocks(ctx, s, "h2")
+	if blocks, _ = s.GetBlocks(ctx); blocks["10.0.0.8/29"] != "h2" {
+		t.Errorf("block with a borrowed ip released: %v", blocks)
+	}
+	mustRelease(t, a, "e")
+	// 释放时只检查释放的ip所在的块
+	releaseBlocks(ctx, s, "h2", []net.IP{net.ParseIP("10.0.0.2")})
+	if blocks, _ = s.GetBlocks(ctx); blocks["10.0.0.8/29"] != "h2" {
+		t.Errorf("block without released ips checked: %v", blocks)
+	}
+	releaseBlocks(ctx, s, "h2", []net.IP{net.ParseIP("10.0.0.10")})
+	if blocks, _ = s.GetBlocks(ctx); len(blocks) != 1 || blocks["10.0.0.0/29"] != "h1" {
+		t.Errorf("empty block not released: %v", blocks)
+	}
+}
@@ -0,0 +1,27 @@
+package allocator
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"neutron/pkg/config"
+)
+
+func TestCooldownSkipsReleasedIP(t *testing.T) {
+	s := openStore(t)
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), s, 0, config.StrategyLowestFree, 0)
+	mustGet(t, a, owner("a", "h1")) // .2
+	s.SetCooldown(time.Hour)
+	mustRelease(t, a, "a")
+
+	if got := mustGet(t, a, owner("b", "h1")); got != "10.0.0.3" {
+		t.Errorf("got %s, want cooling 10.0.0.2 to be skipped", got)
+	}
+	// 指定ip时可以使用冷却中的ip
+	ipConf, _, err := a.Get(context.Background(), owner("c", "h1"), "", net.ParseIP("10.0.0.2"))
+	if err != nil || ipConf.Address.IP.String() != "10.0.0.2" {
+		t.Errorf("requesting a cooling ip: %v, %v", ipConf, err)
+	}
+}
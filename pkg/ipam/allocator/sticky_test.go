@@ -0,0 +1,59 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"neutron/pkg/config"
+)
+
+func TestStickyReclaim(t *testing.T) {
+	ctx := context.Background()
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), openStore(t), 0, config.StrategyLowestFree, 0)
+
+	web := owner("a", "h1")
+	web.Identity = "web-0"
+	if got := mustGet(t, a, web); got != "10.0.0.2" {
+		t.Fatalf("got %s, want 10.0.0.2", got)
+	}
+	if err := a.Hold(ctx, "a", "eth0", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// 保留的ip不会分配给其他pod
+	if got := mustGet(t, a, owner("b", "h2")); got != "10.0.0.3" {
+		t.Errorf("other pod got %s, want held 10.0.0.2 to be skipped", got)
+	}
+	// 同一身份的新容器(可能在其他主机上)取回保留的ip
+	web2 := owner("c", "h2")
+	web2.Identity = "web-0"
+	if got := mustGet(t, a, web2); got != "10.0.0.2" {
+		t.Errorf("same identity got %s, want 10.0.0.2", got)
+	}
+}
+
+func TestStickyHoldExpires(t *testing.T) {
+	ctx := context.Background()
+	s := openStore(t)
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), s, 0, config.StrategyLowestFree, 0)
+
+	web := owner("a", "h1")
+	web.Identity = "web-0"
+	mustGet(t, a, web)
+	if err := a.Hold(ctx, "a", "eth0", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if got := mustGet(t, a, owner("b", "h1")); got != "10.0.0.2" {
+		t.Errorf("got %s, want expired hold 10.0.0.2 to be reused", got)
+	}
+	allocs, err := s.ListAllocations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 1 || allocs[0].Record.Held() {
+		t.Errorf("expired hold not pruned: %+v", allocs)
+	}
+}
@@ -0,0 +1,159 @@
+// copyright @ 2020 ops inc.
+
+package allocator
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"neutron/pkg/config"
+	"neutron/pkg/log"
+)
+
+// Iterator 分配策略: 按策略的顺序返回未使用的ip, Get依次尝试预留
+type Iterator interface {
+	// Next returns the next free IP, its mask, and its gateway. Returns nil
+	// if the iterator has been exhausted
+	Next() (*net.IPNet, net.IP)
+	// Range 最近一次Next返回的ip所在的range
+	Range() *config.Range
+}
+
+// newIterator 根据配置的策略创建遍历器, used为已使用(含冷却中)的ip
+func (a *IPAllocator) newIterator(ctx context.Context, used *usedSet, host string) (Iterator, error) {
+	switch a.strategy {
+	case "", config.StrategyRoundRobin:
+		iter, err := a.GetIter(ctx)
+		if err != nil {
+			return nil, err
+		}
+		iter.used = used
+		return iter, nil
+	case config.StrategyLowestFree:
+		return a.lowestFreeIter(used), nil
+	case config.StrategyRandom:
+		return a.randomIter(used), nil
+	case config.StrategyHostAffinity:
+		return a.hostAffinityIter(ctx, used, host)
+	default:
+		return nil, fmt.Errorf("unknown allocation strategy: %q", a.strategy)
+	}
+}
+
+// lowestFreeIter 总是从第一个range的rangeStart开始, 优先分配最小的空闲ip
+func (a *IPAllocator) lowestFreeIter(used *usedSet) *RangeIter {
+	return &RangeIter{
+		rangeset: a.rangeset,
+		used:     used,
+	}
+}
+
+// randomIter 从随机的range、随机的ip开始顺序遍历, 降低并发分配时的冲突
+func (a *IPAllocator) randomIter(used *usedSet) *RangeIter {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	idx := rnd.Intn(len(*a.rangeset))
+	r := (*a.rangeset)[idx]
+
+	start := new(big.Int).SetBytes(r.RangeStart.To16())
+	end := new(big.Int).SetBytes(r.RangeEnd.To16())
+	size := new(big.Int).Sub(end, start)
+	size.Add(size, big.NewInt(1))
+	offset := new(big.Int).Rand(rnd, size)
+
+	cur := bigToIP(new(big.Int).Add(start, offset), len(r.RangeStart))
+	log.Infof("Get allocates random start ip: %s range: %d", cur, idx)
+
+	// next()会先前进一步, 第一次返回cur+1, 遍历一圈后回到cur结束
+	return &RangeIter{
+		rangeset:   a.rangeset,
+		rangeIdx:   idx,
+		startRange: idx,
+		cur:        cur,
+		used:       used,
+	}
+}
+
+func bigToIP(n *big.Int, length int) net.IP {
+	b := n.Bytes()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip[net.IPv6len-len(b):], b)
+	if length == net.IPv4len {
+		return ip.To4()
+	}
+	return ip
+}
+
+// hostAffinityIter 优先分配之前在当前主机上使用过的空闲ip, 没有时按round-robin分配
+type hostAffinityIter struct {
+	rangeset  *config.RangeSet
+	preferred []net.IP
+	fallback  *RangeIter
+	cur       *config.Range
+}
+
+func (a *IPAllocator) hostAffinityIter(ctx context.Context, used *usedSet, host string) (*hostAffinityIter, error) {
+	fallback, err := a.GetIter(ctx)
+	if err != nil {
+		return nil, err
+	}
+	fallback.used = used
+
+	lastHosts, err := a.store.GetLastHosts(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var preferred []net.IP
+	for ipStr, h := range lastHosts {
+		ip := net.ParseIP(ipStr)
+		if h != host || ip == nil {
+			continue
+		}
+		if err := config.CanonicalizeIP(&ip); err != nil {
+			continue
+		}
+		for i, r := range *a.rangeset {
+			if r.Contains(ip) && !used.Contains(i, ip) && !ip.Equal(r.Gateway) {
+				preferred = append(preferred, ip)
+				break
+			}
+		}
+	}
+	sort.Slice(preferred, func(i, j int) bool {
+		return bytes.Compare(preferred[i].To16(), preferred[j].To16()) < 0
+	})
+	log.Infof("Get allocates host: %s has %d preferred free ips", host, len(preferred))
+
+	return &hostAffinityIter{
+		rangeset:  a.rangeset,
+		preferred: preferred,
+		fallback:  fallback,
+	}, nil
+}
+
+func (i *hostAffinityIter) Next() (*net.IPNet, net.IP) {
+	for len(i.preferred) > 0 {
+		ip := i.preferred[0]
+		i.preferred = i.preferred[1:]
+		r, err := i.rangeset.RangeFor(ip)
+		if err != nil {
+			continue
+		}
+		i.cur = r
+		return &net.IPNet{IP: ip, Mask: r.Subnet.Mask}, r.Gateway
+	}
+	i.cur = nil
+	return i.fallback.Next()
+}
+
+func (i *hostAffinityIter) Range() *config.Range {
+	if i.cur != nil {
+		return i.cur
+	}
+	return i.fallback.Range()
+}
@@ -0,0 +1,74 @@
+package allocator
+
+import (
+	"context"
+	"testing"
+
+	"neutron/pkg/config"
+)
+
+func TestStrategies(t *testing.T) {
+	// 10.0.0.0/29: 网关.1, 可分配.2-.6
+	tests := []struct {
+		strategy string
+		// 在h1上分配a、b, 释放a后, h1上的下一个容器得到的ip
+		want string
+	}{
+		{strategy: config.StrategyRoundRobin, want: "10.0.0.4"},
+		{strategy: config.StrategyLowestFree, want: "10.0.0.2"},
+		{strategy: config.StrategyHostAffinity, want: "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), openStore(t), 0, tt.strategy, 0)
+			if got := mustGet(t, a, owner("a", "h1")); got != "10.0.0.2" {
+				t.Fatalf("first ip = %s, want 10.0.0.2", got)
+			}
+			if got := mustGet(t, a, owner("b", "h1")); got != "10.0.0.3" {
+				t.Fatalf("second ip = %s, want 10.0.0.3", got)
+			}
+			mustRelease(t, a, "a")
+			if got := mustGet(t, a, owner("c", "h1")); got != tt.want {
+				t.Errorf("after release got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostAffinityPrefersOwnHost(t *testing.T) {
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), openStore(t), 0, config.StrategyHostAffinity, 0)
+	mustGet(t, a, owner("a", "h1")) // .2
+	mustGet(t, a, owner("b", "h2")) // .3
+	mustRelease(t, a, "a")
+	mustRelease(t, a, "b")
+
+	// round-robin会从.4开始, 亲和策略优先取回本主机用过的ip
+	if got := mustGet(t, a, owner("c", "h2")); got != "10.0.0.3" {
+		t.Errorf("h2 got %s, want 10.0.0.3", got)
+	}
+	if got := mustGet(t, a, owner("d", "h1")); got != "10.0.0.2" {
+		t.Errorf("h1 got %s, want 10.0.0.2", got)
+	}
+}
+
+func TestRandomExhaustsRange(t *testing.T) {
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), openStore(t), 0, config.StrategyRandom, 0)
+	seen := map[string]bool{}
+	for _, id := range []string{"a", "b", "c", "d", "e"} {
+		got := mustGet(t, a, owner(id, "h1"))
+		if seen[got] || got == "10.0.0.1" {
+			t.Fatalf("random allocated %s twice or the gateway", got)
+		}
+		seen[got] = true
+	}
+	if _, _, err := a.Get(context.Background(), owner("f", "h1"), "", nil); err == nil {
+		t.Errorf("allocation from a full range succeeded")
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	a := NewIPAllocator(newRangeSet(t, "10.0.0.0/29"), openStore(t), 0, "bogus", 0)
+	if _, _, err := a.Get(context.Background(), owner("a", "h1"), "", nil); err == nil {
+		t.Errorf("unknown strategy accepted")
+	}
+}
@@ -0,0 +1,180 @@
+// copyright @ 2020 ops inc.
+
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"neutron/pkg/config"
+	"neutron/pkg/etcd"
+	"neutron/pkg/ipam/allocator"
+	"neutron/pkg/log"
+	"neutron/pkg/store"
+)
+
+// GCOptions 回收泄漏ip的参数
+type GCOptions struct {
+	Host     string          // 只回收该主机上的分配记录
+	ValidIDs map[string]bool // 存活的container id; 为nil时根据记录的netns是否存在判断
+	MinAge   time.Duration   // 分配时间不足MinAge的记录不回收, 避免与正在进行的ADD冲突
+	DryRun   bool            // 只报告, 不释放
+}
+
+// GCItem 一条被回收(或将被回收)的分配记录
+type GCItem struct {
+	Service     string `json:"service"`
+	IP          string `json:"ip"`
+	ContainerID string `json:"containerID"`
+	IfName      string `json:"ifname"`
+	PodName     string `json:"podName,omitempty"`
+	Netns       string `json:"netns,omitempty"`
+	Reason      string `json:"reason"`
+}
+
+// GCReport 回收结果
+type GCReport struct {
+	DryRun   bool     `json:"dryRun"`
+	Checked  int      `json:"checked"`
+	Released []GCItem `json:"released"`
+	Skipped  []GCItem `json:"skipped,omitempty"` // 无法判断是否存活的记录
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// ExecGC 遍历所有服务下属于当前主机的分配记录, 释放容器已不存在的ip.
+// DEL没有执行(节点宕机、kubelet异常)时, endpoint会一直占用, 需要定期回收
+func ExecGC(ctx context.Context, backend store.Backend, opts *GCOptions) (*GCReport, error) {
+	log.Infof("GC start host: %s dry-run: %t", opts.Host, opts.DryRun)
+
+	services, err := backend.ListServices(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &GCReport{DryRun: opts.DryRun, Released: []GCItem{}}
+	for _, service := range services {
+		if err := gcService(ctx, backend, service, opts, report); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("service %s: %v", service, err))
+		}
+	}
+	log.Infof("GC finished checked: %d released: %d skipped: %d", report.Checked, len(report.Released), len(report.Skipped))
+	return report, nil
+}
+
+func gcService(ctx context.Context, backend store.Backend, service string, opts *GCOptions, report *GCReport) error {
+	ipStore, err := backend.Open(ctx, service, "")
+	if err != nil {
+		return err
+	}
+	defer ipStore.Close()
+	ipStore.SetCooldown(serviceCooldown(ctx, backend, service))
+
+	if err := ipStore.Lock(ctx); err != nil {
+		return err
+	}
+	defer ipStore.Unlock()
+
+	allocations, err := ipStore.ListAllocations(ctx)
+	if err != nil {
+		return err
+	}
+
+	released := map[string]bool{}
+	for _, alloc := range allocations {
+		rec := alloc.Record
+		if rec.Host != opts.Host {
+			continue
+		}
+		report.Checked++
+
+		item := GCItem{
+			Service:     service,
+			IP:          alloc.IP.String(),
+			ContainerID: rec.ContainerID,
+			IfName:      rec.IfName,
+			PodName:     rec.PodName,
+			Netns:       rec.Netns,
+		}
+		// 粘性保留的记录不属于任何容器: etcd中由租约自动删除, memory存储自行清理, disk存储在过期后回收
+		if rec.Held() {
+			if !rec.Expired(time.Now()) {
+				continue
+			}
+			item.Reason = "sticky hold expired"
+			if !opts.DryRun {
+				if err := ipStore.Release(ctx, alloc.IP); err != nil {
+					report.Errors = append(report.Errors, fmt.Sprintf("release %s %s: %v", service, item.IP, err))
+					continue
+				}
+			}
+			report.Released = append(report.Released, item)
+			continue
+		}
+		if !rec.AllocatedAt.IsZero() && time.Since(rec.AllocatedAt) < opts.MinAge {
+			continue
+		}
+
+		orphan, reason := isOrphan(rec, opts)
+		item.Reason = reason
+		if !orphan {
+			if reason != "" {
+				report.Skipped = append(report.Skipped, item)
+			}
+			continue
+		}
+
+		// 同一个容器的所有ip在ReleaseByID里一起释放
+		owner := rec.ContainerID + "/" + rec.IfName
+		if !opts.DryRun && !released[owner] {
+			if err := ipStore.ReleaseByID(ctx, rec.ContainerID, rec.IfName); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("release %s %s: %v", service, item.IP, err))
+				continue
+			}
+			released[owner] = true
+		}
+		log.Infof("GC release service: %s ip: %s container: %s reason: %s", service, item.IP, rec.ContainerID, reason)
+		report.Released = append(report.Released, item)
+	}
+
+	// 按块分配时归还该主机已空的块
+	if !opts.DryRun {
+		allocator.ReleaseEmptyBlocks(ctx, ipStore, opts.Host)
+	}
+	return nil
+}
+
+// serviceCooldown 读取服务配置中的冷却时间, 服务配置已不存在或非法时不冷却
+func serviceCooldown(ctx context.Context, backend store.Backend, service string) time.Duration {
+	data, err := backend.GetServiceConf(ctx, service)
+	if err != nil {
+		return 0
+	}
+	n, err := config.ReadTotalConf(data)
+	if err != nil || n.IPAM == nil {
+		return 0
+	}
+	return n.IPAM.CooldownDuration()
+}
+
+// isOrphan 判断分配记录对应的容器是否已不存在; 无法判断时返回false并给出原因
+func isOrphan(rec *etcd.Record, opts *GCOptions) (bool, string) {
+	if opts.ValidIDs != nil {
+		if opts.ValidIDs[rec.ContainerID] {
+			return false, ""
+		}
+		return true, "container id not in valid list"
+	}
+
+	if rec.Netns == "" {
+		return false, "record has no netns"
+	}
+	if _, err := os.Stat(rec.Netns); err != nil {
+		if os.IsNotExist(err) {
+			return true, "netns not exist"
+		}
+		return false, fmt.Sprintf("stat netns failed: %v", err)
+	}
+	return false, ""
+}
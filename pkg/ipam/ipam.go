@@ -15,72 +15,79 @@
 package ipam
 
 import (
+	"context"
 	"fmt"
 	"net"
-	"strings"
+	"os"
 
 	"github.com/containernetworking/cni/pkg/skel"
-	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/current"
-	"github.com/coreos/etcd/clientv3"
+	current "github.com/containernetworking/cni/pkg/types/100"
 
 	"neutron/pkg/config"
 	"neutron/pkg/etcd"
 	"neutron/pkg/ipam/allocator"
 	"neutron/pkg/log"
+	"neutron/pkg/store"
 	"neutron/pkg/util"
 )
 
-func ExecCheck(client *clientv3.Client, conf *config.NetConf, args *skel.CmdArgs) error {
+func ExecCheck(ctx context.Context, backend store.Backend, ident *util.Identity, conf *config.NetConf, args *skel.CmdArgs) error {
 	log.Info("IPAM check start check config.")
 
-	envArgs := args.Args
-	service, podname := util.GetCurrentServiceAndPod(envArgs)
-	if service == "" {
-		return fmt.Errorf("IPAM check get service from args: %s failed", envArgs)
-	}
-
 	// Look to see if there is at least one IP address allocated to the container
 	// in the data dir, irrespective of what that address actually is
-	store, err := etcd.New(client, service, podname)
+	ipStore, err := backend.Open(ctx, ident.Service, ident.PodName)
 	if err != nil {
 		return err
 	}
-	defer store.Close()
+	defer ipStore.Close()
 
-	containerIpFound := store.FindByID(args.ContainerID, args.IfName)
+	containerIpFound, err := ipStore.FindByID(ctx, args.ContainerID, args.IfName)
+	if err != nil {
+		return err
+	}
 	if containerIpFound == false {
 		return fmt.Errorf("IPAM-etcd: Failed to find address added by container %v", args.ContainerID)
 	}
 	return nil
 }
 
-func ExecAdd(client *clientv3.Client, conf *config.NetConf, args *skel.CmdArgs) (types.Result, error) {
+// ExecAdd 为容器分配ip. 重试ADD时复用该容器已有的分配; prior为本次调用之前该容器已有的ip,
+// 属于之前成功的ADD, 调用方失败回滚时(ExecRelease)需保留
+func ExecAdd(ctx context.Context, backend store.Backend, ident *util.Identity, conf *config.NetConf, args *skel.CmdArgs) (*current.Result, []net.IP, error) {
 	log.Info("IPAM add start allocate ip")
 
-	envArgs := args.Args
-	service, podname := util.GetCurrentServiceAndPod(envArgs)
-	if service == "" {
-		return nil, fmt.Errorf("IPAM add get service from args: %s failed", envArgs)
-	}
-
-	ipamConf, _, err := config.LoadIPAMConfig(conf, envArgs)
+	ipamConf, _, err := config.LoadIPAMConfig(conf, ident.Args)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	log.Infof("IPAM add get IPArgs: %+v", ipamConf.IPArgs) // []
 
 	result := &current.Result{}
 
-	store, err := etcd.New(client, service, podname)
+	ipStore, err := backend.Open(ctx, ident.Service, ident.PodName)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	defer ipStore.Close()
+
+	owner, err := newRecord(args, ident)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ipamConf.Sticky != nil {
+		if owner.Identity, err = ipamConf.Sticky.Identity(ident.PodName); err != nil {
+			return nil, nil, err
+		}
+		log.Infof("IPAM add sticky identity: %s", owner.Identity)
 	}
-	defer store.Close()
 
-	// Keep the allocators we used, so we can release all IPs if an error
-	// occurs after we start allocating
-	allocs := []*allocator.IPAllocator{}
+	// 分配之前记下该容器已有的ip, 失败时只回滚本次分配的ip
+	prior, err := ipStore.GetByID(ctx, args.ContainerID, args.IfName)
+	if err != nil {
+		return nil, nil, err
+	}
+	rollback := allocator.NewIPAllocator(nil, ipStore, 0, ipamConf.Strategy, ipamConf.BlockSize)
 
 	// Store all requested IPs in a map, so we can easily remove ones we use
 	// and error if some remain
@@ -92,7 +99,7 @@ func ExecAdd(client *clientv3.Client, conf *config.NetConf, args *skel.CmdArgs)
 	log.Infof("IPAM add get requestedIPs: %+v", requestedIPs) // map[]
 
 	for idx, rangeset := range ipamConf.Ranges {
-		ipAllocator := allocator.NewIPAllocator(&rangeset, store, idx)
+		ipAllocator := allocator.NewIPAllocator(&rangeset, ipStore, idx, ipamConf.Strategy, ipamConf.BlockSize)
 		log.Infof("IPAM add handle idx: %d rangeset: %+v", idx, rangeset)
 
 		// Check to see if there are any custom IPs requested in this range.
@@ -108,68 +115,128 @@ func ExecAdd(client *clientv3.Client, conf *config.NetConf, args *skel.CmdArgs)
 		log.Infof("IPAM add get requestedIP is: %v", requestedIP) // <nil>
 
 		// 分配ip, 并写入etcd
-		ipConf, err := ipAllocator.Get(args.ContainerID, args.IfName, envArgs, requestedIP)
+		ipConf, _, err := ipAllocator.Get(ctx, owner, ident.Stage, requestedIP)
 		if err != nil {
-			// Deallocate all already allocated IPs
-			for _, alloc := range allocs {
-				_ = alloc.Release(args.ContainerID, args.IfName)
-			}
-			return nil, fmt.Errorf("failed to allocate for range %d: %v", idx, err)
+			// Deallocate all already allocated IPs; 超时时当前range的ip可能已写入存储但未返回结果, 一并释放
+			releaseAll(rollback, args, prior)
+			return nil, nil, fmt.Errorf("failed to allocate for range %d: %v", idx, err)
 		}
 
-		allocs = append(allocs, ipAllocator)
-
 		result.IPs = append(result.IPs, ipConf)
 	}
 	log.Infof("Cmd add fetch finally result ips: %+v", result.IPs)
 
 	// If an IP was requested that wasn't fulfilled, fail
 	if len(requestedIPs) != 0 {
-		for _, alloc := range allocs {
-			_ = alloc.Release(args.ContainerID, args.IfName)
-		}
+		releaseAll(rollback, args, prior)
 		errstr := "failed to allocate all requested IPs:"
 		for _, ip := range requestedIPs {
 			errstr = errstr + " " + ip.String()
 		}
-		return nil, fmt.Errorf(errstr)
+		return nil, nil, fmt.Errorf(errstr)
 	}
 
 	result.Routes = ipamConf.Routes
-	return result, nil
+	return result, prior, nil
 }
 
-func ExecDel(client *clientv3.Client, conf *config.NetConf, args *skel.CmdArgs) error {
-	log.Info("IPAM del start delete ip.")
+// releaseAll 分配失败时释放该容器本次分配的ip, 保留之前的ADD已分配的ip(prior).
+// 调用方的ctx可能已经到期, 使用独立的ctx回滚
+func releaseAll(alloc *allocator.IPAllocator, args *skel.CmdArgs, prior []net.IP) {
+	ctx, cancel := util.RollbackContext()
+	defer cancel()
+	if err := alloc.ReleaseExcept(ctx, args.ContainerID, args.IfName, prior); err != nil {
+		log.Warnf("IPAM add rollback release container: %s failed: %v", args.ContainerID, err)
+	}
+}
 
-	envArgs := args.Args
-	service, podname := util.GetCurrentServiceAndPod(envArgs)
-	if service == "" {
-		return fmt.Errorf("Cmd add fetch service from args: %s is failed", envArgs)
+// claimedBlockSize 返回已申领的块的掩码长度, 没有申领的块(不按块分配)时返回0
+func claimedBlockSize(ctx context.Context, ipStore etcd.Storager) int {
+	blocks, err := ipStore.GetBlocks(ctx)
+	if err != nil {
+		log.Warnf("IPAM del get blocks failed: %v", err)
+		return 0
+	}
+	for cidr := range blocks {
+		if _, block, err := net.ParseCIDR(cidr); err == nil {
+			ones, _ := block.Mask.Size()
+			return ones
+		}
+	}
+	return 0
+}
+
+// ExecRelease ADD失败回滚时释放本次分配的ip, prior为ExecAdd返回的之前已有的ip, 不释放.
+// 与ExecDel不同, 不为sticky服务保留ip, 也不进入冷却: 这些ip没有被容器真正使用过
+func ExecRelease(ctx context.Context, backend store.Backend, ident *util.Identity, conf *config.NetConf, args *skel.CmdArgs, prior []net.IP) error {
+	ipamConf := &config.IPAMConfig{}
+	if conf != nil && conf.IPAM != nil {
+		ipamConf = conf.IPAM
 	}
 
-	ipamConf, _, err := config.LoadIPAMConfig(conf, envArgs)
+	ipStore, err := backend.Open(ctx, ident.Service, ident.PodName)
 	if err != nil {
 		return err
 	}
+	defer ipStore.Close()
+
+	ipAllocator := allocator.NewIPAllocator(nil, ipStore, 0, ipamConf.Strategy, ipamConf.BlockSize)
+	if err := ipAllocator.ReleaseExcept(ctx, args.ContainerID, args.IfName, prior); err != nil {
+		return err
+	}
+	log.Infof("IPAM rollback release container: %s success", args.ContainerID)
+	return nil
+}
 
-	store, err := etcd.New(client, service, podname)
+// newRecord 根据CNI参数生成该容器的分配记录
+func newRecord(args *skel.CmdArgs, ident *util.Identity) (*etcd.Record, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &etcd.Record{
+		ContainerID:  args.ContainerID,
+		IfName:       args.IfName,
+		Netns:        args.Netns,
+		PodNamespace: ident.PodNamespace,
+		PodName:      ident.PodName,
+		Host:         hostname,
+	}, nil
+}
+
+// ExecDel 按(containerID, ifname)的分配记录释放ip, 与当前的range配置无关, 服务配置被删除(conf为nil)
+// 或修改后已分配的ip仍能释放. 服务配置存在时按其sticky、cooldown、blockSize释放,
+// 不存在时blockSize从块的申领记录推断
+func ExecDel(ctx context.Context, backend store.Backend, ident *util.Identity, conf *config.NetConf, args *skel.CmdArgs) error {
+	log.Info("IPAM del start delete ip.")
+
+	ipamConf := &config.IPAMConfig{}
+	if conf != nil && conf.IPAM != nil {
+		ipamConf = conf.IPAM
+	}
+
+	ipStore, err := backend.Open(ctx, ident.Service, ident.PodName)
 	if err != nil {
 		return err
 	}
-	defer store.Close()
+	defer ipStore.Close()
 
-	// Loop through all ranges, releasing all IPs, even if an error occurs
-	var errors []string
-	for idx, rangeset := range ipamConf.Ranges {
-		ipAllocator := allocator.NewIPAllocator(&rangeset, store, idx)
-		if err := ipAllocator.Release(args.ContainerID, args.IfName); err != nil {
-			errors = append(errors, err.Error())
-		}
+	ipStore.SetCooldown(ipamConf.CooldownDuration())
+	// 服务配置已删除时从块的申领记录推断blockSize, 释放ip后仍能归还本机已空的块
+	if conf == nil || conf.IPAM == nil {
+		ipamConf.BlockSize = claimedBlockSize(ctx, ipStore)
 	}
 
-	if errors != nil {
-		return fmt.Errorf(strings.Join(errors, ";"))
+	// 释放只依赖分配记录, 不需要range; 容器没有分配记录时什么都不做
+	ipAllocator := allocator.NewIPAllocator(nil, ipStore, 0, ipamConf.Strategy, ipamConf.BlockSize)
+	if ipamConf.Sticky != nil {
+		// 粘性ip: 为pod身份保留, gracePeriod后才真正释放
+		err = ipAllocator.Hold(ctx, args.ContainerID, args.IfName, ipamConf.Sticky.Grace())
+	} else {
+		err = ipAllocator.Release(ctx, args.ContainerID, args.IfName)
+	}
+	if err != nil {
+		return err
 	}
 	log.Infof("IPAM del release container: %s success", args.ContainerID)
 	return nil
@@ -0,0 +1,140 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+
+	"neutron/pkg/config"
+	"neutron/pkg/etcd"
+	"neutron/pkg/log"
+	"neutron/pkg/store"
+	"neutron/pkg/util"
+)
+
+func TestMain(m *testing.M) {
+	log.InitCliLogger()
+	os.Exit(m.Run())
+}
+
+// TestExecDelWithoutConf 服务配置已删除时, 释放ip后仍归还本机已空的块
+func TestExecDelWithoutConf(t *testing.T) {
+	ctx := context.Background()
+	host, err := os.Hostname()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := store.NewMemory()
+	s, err := backend.Open(ctx, "svc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, block, _ := net.ParseCIDR("10.0.0.0/29")
+	if ok, err := s.ClaimBlock(ctx, block, host); !ok || err != nil {
+		t.Fatalf("claim block: %t, %v", ok, err)
+	}
+	rec := &etcd.Record{ContainerID: "a", IfName: "eth0", Host: host}
+	if ok, err := s.Reserve(ctx, rec, net.ParseIP("10.0.0.2")); !ok || err != nil {
+		t.Fatalf("reserve: %t, %v", ok, err)
+	}
+
+	args := &skel.CmdArgs{ContainerID: "a", IfName: "eth0"}
+	if err := ExecDel(ctx, backend, &util.Identity{Service: "svc"}, nil, args); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := s.FindByID(ctx, "a", "eth0"); found || err != nil {
+		t.Errorf("ip of container a not released")
+	}
+	if blocks, _ := s.GetBlocks(ctx); len(blocks) != 0 {
+		t.Errorf("empty block not released: %v", blocks)
+	}
+}
+
+const (
+	rangeA = `[{"subnet": "10.0.0.0/29"}]`
+	// rangeB 只有一个ip, 被容器b占用后分配失败
+	rangeB = `[{"subnet": "10.0.1.0/29", "rangeStart": "10.0.1.2", "rangeEnd": "10.0.1.2"}]`
+)
+
+func netConf(t *testing.T, ranges ...string) *config.NetConf {
+	t.Helper()
+	data := `{"ipam": {"ranges": [`
+	for i, r := range ranges {
+		if i > 0 {
+			data += ","
+		}
+		data += r
+	}
+	data += `]}}`
+	n := &config.NetConf{}
+	if err := json.Unmarshal([]byte(data), n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// TestExecAddRollback ADD失败时只回滚本次分配的ip, 重试ADD复用的之前的分配保留
+func TestExecAddRollback(t *testing.T) {
+	ctx := context.Background()
+	backend := store.NewMemory()
+	s, err := backend.Open(ctx, "svc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.Reserve(ctx, &etcd.Record{ContainerID: "b", IfName: "eth0"}, net.ParseIP("10.0.1.2")); !ok || err != nil {
+		t.Fatalf("reserve: %t, %v", ok, err)
+	}
+	ident := &util.Identity{Service: "svc"}
+	args := &skel.CmdArgs{ContainerID: "a", IfName: "eth0"}
+
+	first, prior, err := ExecAdd(ctx, backend, ident, netConf(t, rangeA), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(prior) != 0 {
+		t.Fatalf("first add prior: %v", prior)
+	}
+	ip := first.IPs[0].Address.IP
+
+	// 重试ADD复用了rangeA的ip, 之后rangeB分配失败
+	if _, _, err := ExecAdd(ctx, backend, ident, netConf(t, rangeA, rangeB), args); err == nil {
+		t.Fatal("add with exhausted range succeeded")
+	}
+	// 重试ADD请求的ip与已分配的不一致
+	ident.Args = &util.CNIArgs{IP: net.ParseIP("10.0.0.5")}
+	if _, _, err := ExecAdd(ctx, backend, ident, netConf(t, rangeA), args); err == nil {
+		t.Fatal("add with mismatched requested ip succeeded")
+	}
+	ident.Args = nil
+	if ips, err := s.GetByID(ctx, "a", "eth0"); err != nil || len(ips) != 1 || !ips[0].Equal(ip) {
+		t.Fatalf("ips of container a after failed retries: %v, %v, want [%s]", ips, err, ip)
+	}
+
+	// 重试成功后, 调用方回滚不释放之前的ip
+	again, prior, err := ExecAdd(ctx, backend, ident, netConf(t, rangeA), args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !again.IPs[0].Address.IP.Equal(ip) || !etcd.ContainsIP(prior, ip) {
+		t.Fatalf("retry got %s prior %v, want %s", again.IPs[0].Address.IP, prior, ip)
+	}
+	if err := ExecRelease(ctx, backend, ident, nil, args, prior); err != nil {
+		t.Fatal(err)
+	}
+	if found, err := s.FindByID(ctx, "a", "eth0"); !found || err != nil {
+		t.Fatalf("reused ip released by rollback: %t, %v", found, err)
+	}
+
+	// 新容器分配失败时, 已分配的rangeA的ip被释放
+	args = &skel.CmdArgs{ContainerID: "c", IfName: "eth0"}
+	if _, _, err := ExecAdd(ctx, backend, ident, netConf(t, rangeA, rangeB), args); err == nil {
+		t.Fatal("add with exhausted range succeeded")
+	}
+	if found, err := s.FindByID(ctx, "c", "eth0"); found || err != nil {
+		t.Errorf("ip of container c not rolled back: %t, %v", found, err)
+	}
+}
@@ -47,6 +47,14 @@ func InitLogger(logFile string) {
 	logger = logging.WithFields(logrus.Fields{})
 }
 
+// InitCliLogger 命令行工具使用: 只输出warn及以上级别到stderr, 不干扰stdout的输出
+func InitCliLogger() {
+	logging.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	logging.SetOutput(os.Stderr)
+	logging.SetLevel(logrus.WarnLevel)
+	logger = logging.WithFields(logrus.Fields{})
+}
+
 func InitFields(fields Fields) {
 	fieldInfo := logrus.Fields{}
 	for k, v := range fields {
@@ -0,0 +1,517 @@
+// copyright @ 2020 ops inc.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+
+	"neutron/pkg/config"
+	"neutron/pkg/etcd"
+	"neutron/pkg/log"
+)
+
+const (
+	defaultDataDir    = "/var/lib/cni/neutron"
+	lockRetryInterval = 10 * time.Millisecond
+)
+
+func init() {
+	Register(STORE_DISK, newDiskBackend)
+}
+
+// diskBackend 本地文件存储后端(参考host-local), 目录结构与etcd的key保持一致:
+//
+//	<dataDir>/service/<svc>             服务配置
+//	<dataDir>/endpoints/<svc>/<ip>      已分配ip
+//	<dataDir>/lastreserved/<svc>/<idx>  最后分配的ip
+//	<dataDir>/lock/<svc>                服务锁(flock)
+//	<dataDir>/hosts/<svc>/<ip>          ip最后分配的主机
+//	<dataDir>/blocks/<svc>/<ip>_<len>   按块分配时申领的块, 内容为主机名
+type diskBackend struct {
+	dataDir string
+}
+
+func newDiskBackend(conf *config.LocalConf) (Backend, error) {
+	dataDir := conf.DataDir
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, err
+	}
+	return &diskBackend{dataDir: dataDir}, nil
+}
+
+func (b *diskBackend) GetServiceConf(ctx context.Context, service string) ([]byte, error) {
+	path := filepath.Join(b.dataDir, "service", service)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read service %s config failed: %v", service, err)
+	}
+	log.Infof("Get service: %s config from %s value: %s", service, path, string(data))
+	return data, nil
+}
+
+func (b *diskBackend) PutServiceConf(ctx context.Context, service string, conf []byte) error {
+	dir := filepath.Join(b.dataDir, "service")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, service), conf, 0644)
+}
+
+func (b *diskBackend) ListServices(ctx context.Context) ([]string, error) {
+	seen := map[string]bool{}
+	for _, dir := range []string{"service", "endpoints"} {
+		files, err := ioutil.ReadDir(filepath.Join(b.dataDir, dir))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, file := range files {
+			if dir == "service" || file.IsDir() {
+				seen[file.Name()] = true
+			}
+		}
+	}
+	return sortedKeys(seen), nil
+}
+
+// Ping 数据目录可访问即可用
+func (b *diskBackend) Ping(ctx context.Context) error {
+	_, err := os.Stat(b.dataDir)
+	return err
+}
+
+func (b *diskBackend) Open(ctx context.Context, service, podname string) (etcd.Storager, error) {
+	s := &diskStore{
+		endpointsDir:    filepath.Join(b.dataDir, "endpoints", service),
+		lastReservedDir: filepath.Join(b.dataDir, "lastreserved", service),
+		releasedDir:     filepath.Join(b.dataDir, "released", service),
+		hostsDir:        filepath.Join(b.dataDir, "hosts", service),
+		blocksDir:       filepath.Join(b.dataDir, "blocks", service),
+	}
+	for _, dir := range []string{s.endpointsDir, s.lastReservedDir, s.releasedDir, s.hostsDir, s.blocksDir, filepath.Join(b.dataDir, "lock")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	lockPath := filepath.Join(b.dataDir, "lock", service)
+	s.lockFile, err = os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (b *diskBackend) Close() error {
+	return nil
+}
+
+// diskStore 实现etcd.Storager, 每个ip一个文件, 内容为json格式的分配记录
+type diskStore struct {
+	endpointsDir    string
+	lastReservedDir string
+	releasedDir     string // 冷却中的ip, 文件内容为冷却结束时间
+	hostsDir        string // ip最后分配的主机, 文件内容为主机名
+	blocksDir       string // 申领的块, 文件名为cidr('/'替换为'_')
+	lockFile        *os.File
+	cooldown        time.Duration
+}
+
+var _ etcd.Storager = &diskStore{}
+
+// Lock flock不能被取消, 以非阻塞方式重试直到获取到锁或ctx到期
+func (s *diskStore) Lock(ctx context.Context) error {
+	for {
+		err := syscall.Flock(int(s.lockFile.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != syscall.EWOULDBLOCK {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("acquire lock %s failed: %v", s.lockFile.Name(), ctx.Err())
+		case <-time.After(lockRetryInterval):
+		}
+	}
+}
+
+// LockHost 本地文件只在当前主机上使用, 与Lock相同
+func (s *diskStore) LockHost(ctx context.Context) error {
+	return s.Lock(ctx)
+}
+
+func (s *diskStore) Unlock() error {
+	return syscall.Flock(int(s.lockFile.Fd()), syscall.LOCK_UN)
+}
+
+func (s *diskStore) Close() error {
+	return s.lockFile.Close()
+}
+
+func (s *diskStore) Reserve(ctx context.Context, rec *etcd.Record, ip net.IP) (bool, error) {
+	value, err := rec.Marshal()
+	if err != nil {
+		return false, err
+	}
+
+	path := filepath.Join(s.endpointsDir, ip.String())
+	// 过期的粘性保留记录视为空闲
+	if cur, err := s.readRecord(ip); err == nil && cur.Expired(time.Now()) {
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := f.Write(value); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return false, err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	// 指定ip分配时ip可能仍在冷却
+	os.Remove(filepath.Join(s.releasedDir, ip.String()))
+	log.Infof("reserve store endpoint file: %s value: %s success", path, value)
+
+	lastPath := filepath.Join(s.lastReservedDir, rec.RangeID)
+	if err := ioutil.WriteFile(lastPath, []byte(ip.String()), 0644); err != nil {
+		return false, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.hostsDir, ip.String()), []byte(rec.Host), 0644); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *diskStore) GetLastHosts(ctx context.Context) (map[string]string, error) {
+	files, err := ioutil.ReadDir(s.hostsDir)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]string, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(s.hostsDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		results[file.Name()] = string(data)
+	}
+	return results, nil
+}
+
+func blockFileName(block *net.IPNet) string {
+	return strings.Replace(block.String(), "/", "_", 1)
+}
+
+func (s *diskStore) GetBlocks(ctx context.Context) (map[string]string, error) {
+	files, err := ioutil.ReadDir(s.blocksDir)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]string, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(filepath.Join(s.blocksDir, file.Name()))
+		if err != nil {
+			continue
+		}
+		results[strings.Replace(file.Name(), "_", "/", 1)] = string(data)
+	}
+	return results, nil
+}
+
+func (s *diskStore) ClaimBlock(ctx context.Context, block *net.IPNet, host string) (bool, error) {
+	f, err := os.OpenFile(filepath.Join(s.blocksDir, blockFileName(block)), os.O_RDWR|os.O_EXCL|os.O_CREATE, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := f.Write([]byte(host)); err != nil {
+		os.Remove(f.Name())
+		return false, err
+	}
+	return true, nil
+}
+
+// BlockInUse 只读取块内ip对应的文件, 过期的粘性保留记录视为空闲
+func (s *diskStore) BlockInUse(ctx context.Context, block *net.IPNet) (bool, error) {
+	now := time.Now()
+	for cur := block.IP; block.Contains(cur); cur = ip.NextIP(cur) {
+		rec, err := s.readRecord(cur)
+		if os.IsNotExist(err) {
+			continue
+		}
+		// 无法解析的记录文件仍占着该ip(Reserve以O_EXCL创建文件会失败), 视为已分配, 块不能归还.
+		// GetAllEndpoins跳过这些文件, 只是遍历时不会预先跳过该ip
+		if err != nil || !rec.Expired(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *diskStore) ReleaseBlock(ctx context.Context, block *net.IPNet, host string) error {
+	path := filepath.Join(s.blocksDir, blockFileName(block))
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(data) != host {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+func (s *diskStore) LastReservedIP(ctx context.Context, rangeID string) (net.IP, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.lastReservedDir, rangeID))
+	if err != nil {
+		return nil, err
+	}
+	return net.ParseIP(string(data)), nil
+}
+
+func (s *diskStore) Release(ctx context.Context, ip net.IP) error {
+	path := filepath.Join(s.endpointsDir, ip.String())
+	rec, _ := s.readRecord(ip)
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	log.Infof("release endpoint file: %s success", path)
+
+	// 粘性保留过期的ip已经空闲了gracePeriod, 不再冷却
+	if s.cooldown > 0 && (rec == nil || !rec.Held()) {
+		until := time.Now().Add(s.cooldown).Format(time.RFC3339Nano)
+		if err := ioutil.WriteFile(filepath.Join(s.releasedDir, ip.String()), []byte(until), 0644); err != nil {
+			return err
+		}
+		log.Infof("cool down released ip: %s until: %s", ip, until)
+	}
+	return nil
+}
+
+func (s *diskStore) SetCooldown(cooldown time.Duration) {
+	s.cooldown = cooldown
+}
+
+// GetCooling 返回仍在冷却的ip, 顺带删除已到期的文件
+func (s *diskStore) GetCooling(ctx context.Context) ([]net.IP, error) {
+	files, err := ioutil.ReadDir(s.releasedDir)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var results []net.IP
+	for _, file := range files {
+		path := filepath.Join(s.releasedDir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		until, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(string(data)))
+		if err != nil || now.After(until) {
+			os.Remove(path)
+			continue
+		}
+		if ip := net.ParseIP(file.Name()); ip != nil {
+			results = append(results, ip)
+		}
+	}
+	return results, nil
+}
+
+// ReleaseByID This function eats errors to be tolerant and release as much as possible
+func (s *diskStore) ReleaseByID(ctx context.Context, id string, ifname string) error {
+	return s.ReleaseExcept(ctx, id, ifname, nil)
+}
+
+func (s *diskStore) ReleaseExcept(ctx context.Context, id string, ifname string, keep []net.IP) error {
+	endpoints, err := s.listEndpoints()
+	if err != nil {
+		return err
+	}
+	for ip, rec := range endpoints {
+		if !rec.Match(id, ifname) || etcd.ContainsIP(keep, net.ParseIP(ip)) {
+			continue
+		}
+		if err := s.Release(ctx, net.ParseIP(ip)); err != nil {
+			log.Warnf("release endpoint ip: %s by container id: %s failed: %v", ip, id, err)
+		}
+	}
+	return nil
+}
+
+func (s *diskStore) GetByID(ctx context.Context, id string, ifname string) ([]net.IP, error) {
+	endpoints, err := s.listEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	var result []net.IP
+	for ip, rec := range endpoints {
+		if rec.Match(id, ifname) {
+			result = append(result, net.ParseIP(ip))
+		}
+	}
+	return result, nil
+}
+
+func (s *diskStore) FindByID(ctx context.Context, id string, ifname string) (bool, error) {
+	ips, err := s.GetByID(ctx, id, ifname)
+	return len(ips) > 0, err
+}
+
+func (s *diskStore) GetAllEndpoins(ctx context.Context) ([]net.IP, error) {
+	endpoints, err := s.listEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	results := make([]net.IP, 0, len(endpoints))
+	for name, rec := range endpoints {
+		// 过期的粘性保留记录视为空闲
+		if rec.Expired(now) {
+			continue
+		}
+		if ip := net.ParseIP(name); ip != nil {
+			results = append(results, ip)
+		}
+	}
+	return results, nil
+}
+
+func (s *diskStore) Hold(ctx context.Context, id string, ifname string, grace time.Duration) error {
+	endpoints, err := s.listEndpoints()
+	if err != nil {
+		return err
+	}
+	for ip, rec := range endpoints {
+		if !rec.Match(id, ifname) {
+			continue
+		}
+		if rec.Identity == "" || grace <= 0 {
+			if err := s.Release(ctx, net.ParseIP(ip)); err != nil {
+				log.Warnf("release endpoint ip: %s by container id: %s failed: %v", ip, id, err)
+			}
+			continue
+		}
+		if err := s.writeRecord(net.ParseIP(ip), rec.Hold(time.Now().Add(grace))); err != nil {
+			return err
+		}
+		log.Infof("hold endpoint ip: %s for identity: %s", ip, rec.Identity)
+	}
+	return nil
+}
+
+func (s *diskStore) GetHeld(ctx context.Context, identity string) ([]net.IP, error) {
+	endpoints, err := s.listEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var results []net.IP
+	for ip, rec := range endpoints {
+		if rec.Held() && rec.Identity == identity && !rec.Expired(now) {
+			results = append(results, net.ParseIP(ip))
+		}
+	}
+	return results, nil
+}
+
+func (s *diskStore) Reclaim(ctx context.Context, rec *etcd.Record, ip net.IP) (bool, error) {
+	cur, err := s.readRecord(ip)
+	if err != nil || !cur.Held() || cur.Identity != rec.Identity || cur.Expired(time.Now()) {
+		return false, nil
+	}
+	if err := s.writeRecord(ip, rec); err != nil {
+		return false, err
+	}
+	log.Infof("reclaim endpoint ip: %s for identity: %s container: %s success", ip, rec.Identity, rec.ContainerID)
+	return true, nil
+}
+
+func (s *diskStore) readRecord(ip net.IP) (*etcd.Record, error) {
+	data, err := ioutil.ReadFile(filepath.Join(s.endpointsDir, ip.String()))
+	if err != nil {
+		return nil, err
+	}
+	return etcd.ParseRecord(data)
+}
+
+func (s *diskStore) writeRecord(ip net.IP, rec *etcd.Record) error {
+	value, err := rec.Marshal()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(s.endpointsDir, ip.String()), value, 0644)
+}
+
+func (s *diskStore) ListAllocations(ctx context.Context) ([]etcd.Allocation, error) {
+	endpoints, err := s.listEndpoints()
+	if err != nil {
+		return nil, err
+	}
+	results := make([]etcd.Allocation, 0, len(endpoints))
+	for ip, rec := range endpoints {
+		results = append(results, etcd.Allocation{IP: net.ParseIP(ip), Record: rec})
+	}
+	return results, nil
+}
+
+// listEndpoints 读取所有endpoint文件(ip -> 分配记录), 旧格式记录自动迁移为json格式
+func (s *diskStore) listEndpoints() (map[string]*etcd.Record, error) {
+	files, err := ioutil.ReadDir(s.endpointsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make(map[string]*etcd.Record, len(files))
+	for _, file := range files {
+		path := filepath.Join(s.endpointsDir, file.Name())
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		rec, err := etcd.ParseRecord(data)
+		if err != nil {
+			log.Warnf("skip endpoint file: %s: %v", path, err)
+			continue
+		}
+		if rec.Legacy() {
+			rec = rec.Migrate()
+			if value, err := rec.Marshal(); err == nil {
+				if err := ioutil.WriteFile(path, value, 0644); err != nil {
+					log.Warnf("migrate endpoint file: %s failed: %v", path, err)
+				}
+			}
+		}
+		results[file.Name()] = rec
+	}
+	return results, nil
+}
@@ -0,0 +1,66 @@
+// copyright @ 2020 ops inc.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+
+	"neutron/pkg/config"
+	"neutron/pkg/etcd"
+)
+
+func init() {
+	Register(STORE_ETCD, newEtcdBackend)
+}
+
+// etcdBackend 默认存储后端, 服务配置及ip分配均保存在etcd
+type etcdBackend struct {
+	conf   *etcd.EtcdConf
+	client *clientv3.Client
+}
+
+func newEtcdBackend(conf *config.LocalConf) (Backend, error) {
+	if conf.Etcd == nil {
+		return nil, fmt.Errorf("store %s requires 'etcd' config", STORE_ETCD)
+	}
+
+	client, err := conf.Etcd.Connect()
+	if err != nil {
+		return nil, err
+	}
+	return &etcdBackend{conf: conf.Etcd, client: client}, nil
+}
+
+func (b *etcdBackend) GetServiceConf(ctx context.Context, service string) ([]byte, error) {
+	return b.conf.GetConfigFromEtcd(ctx, b.client, service)
+}
+
+func (b *etcdBackend) PutServiceConf(ctx context.Context, service string, conf []byte) error {
+	return b.conf.PutConfigToEtcd(ctx, b.client, service, conf)
+}
+
+func (b *etcdBackend) ListServices(ctx context.Context) ([]string, error) {
+	return b.conf.ListServices(ctx, b.client)
+}
+
+func (b *etcdBackend) Ping(ctx context.Context) error {
+	return b.conf.Ping(ctx, b.client)
+}
+
+func (b *etcdBackend) Open(ctx context.Context, service, podname string) (etcd.Storager, error) {
+	s, err := etcd.New(b.client, service, podname)
+	if err != nil {
+		return nil, err
+	}
+	s.LockTTL = b.conf.LockTTL
+	s.LockTimeout = time.Duration(b.conf.LockTimeout) * time.Second
+	return s, nil
+}
+
+func (b *etcdBackend) Close() error {
+	return b.client.Close()
+}
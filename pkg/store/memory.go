@@ -0,0 +1,316 @@
+// copyright @ 2020 ops inc.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"neutron/pkg/config"
+	"neutron/pkg/etcd"
+)
+
+func init() {
+	Register(STORE_MEMORY, func(conf *config.LocalConf) (Backend, error) {
+		return NewMemory(), nil
+	})
+}
+
+// Memory 内存存储后端, 进程退出即丢失, 用于测试allocator
+type Memory struct {
+	mu       sync.Mutex
+	services map[string][]byte
+	pools    map[string]*memoryPool
+}
+
+// memoryPool 单个服务的ip分配信息
+type memoryPool struct {
+	lock         sync.Mutex
+	endpoints    map[string]*etcd.Record // ip -> 分配记录
+	lastReserved map[string]net.IP       // rangeID -> ip
+	released     map[string]time.Time    // ip -> 冷却结束时间
+	hosts        map[string]string       // ip -> 最后分配的主机
+	blocks       map[string]string       // 块(cidr) -> 申领的主机
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		services: map[string][]byte{},
+		pools:    map[string]*memoryPool{},
+	}
+}
+
+// PutServiceConf 写入服务配置
+func (m *Memory) PutServiceConf(ctx context.Context, service string, conf []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.services[service] = conf
+	return nil
+}
+
+func (m *Memory) GetServiceConf(ctx context.Context, service string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	conf, ok := m.services[service]
+	if !ok {
+		return nil, fmt.Errorf("service %s config not found", service)
+	}
+	return conf, nil
+}
+
+func (m *Memory) ListServices(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := map[string]bool{}
+	for service := range m.services {
+		seen[service] = true
+	}
+	for service, pool := range m.pools {
+		if len(pool.endpoints) > 0 {
+			seen[service] = true
+		}
+	}
+	return sortedKeys(seen), nil
+}
+
+func (m *Memory) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (m *Memory) Open(ctx context.Context, service, podname string) (etcd.Storager, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pool, ok := m.pools[service]
+	if !ok {
+		pool = &memoryPool{
+			endpoints:    map[string]*etcd.Record{},
+			lastReserved: map[string]net.IP{},
+			released:     map[string]time.Time{},
+			hosts:        map[string]string{},
+			blocks:       map[string]string{},
+		}
+		m.pools[service] = pool
+	}
+	return &memoryStore{pool: pool}, nil
+}
+
+func (m *Memory) Close() error {
+	return nil
+}
+
+// memoryStore 实现etcd.Storager, 调用方需先Lock再读写
+type memoryStore struct {
+	pool     *memoryPool
+	cooldown time.Duration
+}
+
+var _ etcd.Storager = &memoryStore{}
+
+func (s *memoryStore) Lock(ctx context.Context) error {
+	s.pool.lock.Lock()
+	s.pruneExpired(time.Now())
+	return nil
+}
+
+// pruneExpired 删除已过期的粘性保留记录, 与etcd中租约到期自动删除一致, 避免记录一直留在map中
+func (s *memoryStore) pruneExpired(now time.Time) {
+	for ip, rec := range s.pool.endpoints {
+		if rec.Expired(now) {
+			delete(s.pool.endpoints, ip)
+		}
+	}
+}
+
+// LockHost 内存存储只在单进程内使用, 与Lock相同
+func (s *memoryStore) LockHost(ctx context.Context) error {
+	return s.Lock(ctx)
+}
+
+func (s *memoryStore) Unlock() error {
+	s.pool.lock.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) Reserve(ctx context.Context, rec *etcd.Record, ip net.IP) (bool, error) {
+	key := ip.String()
+	if cur, ok := s.pool.endpoints[key]; ok && !cur.Expired(time.Now()) {
+		return false, nil
+	}
+	s.pool.endpoints[key] = rec
+	s.pool.lastReserved[rec.RangeID] = ip
+	s.pool.hosts[key] = rec.Host
+	delete(s.pool.released, key)
+	return true, nil
+}
+
+func (s *memoryStore) LastReservedIP(ctx context.Context, rangeID string) (net.IP, error) {
+	ip, ok := s.pool.lastReserved[rangeID]
+	if !ok {
+		return nil, fmt.Errorf("Can not find last reserved ip!")
+	}
+	return ip, nil
+}
+
+func (s *memoryStore) Release(ctx context.Context, ip net.IP) error {
+	s.release(ip.String())
+	return nil
+}
+
+func (s *memoryStore) ReleaseByID(ctx context.Context, id string, ifname string) error {
+	return s.ReleaseExcept(ctx, id, ifname, nil)
+}
+
+func (s *memoryStore) ReleaseExcept(ctx context.Context, id string, ifname string, keep []net.IP) error {
+	for ip, rec := range s.pool.endpoints {
+		if rec.Match(id, ifname) && !etcd.ContainsIP(keep, net.ParseIP(ip)) {
+			s.release(ip)
+		}
+	}
+	return nil
+}
+
+// release 删除分配记录, 粘性保留过期的ip之外都进入冷却
+func (s *memoryStore) release(ip string) {
+	rec, ok := s.pool.endpoints[ip]
+	if !ok {
+		return
+	}
+	delete(s.pool.endpoints, ip)
+	if s.cooldown > 0 && !rec.Held() {
+		s.pool.released[ip] = time.Now().Add(s.cooldown)
+	}
+}
+
+func (s *memoryStore) SetCooldown(cooldown time.Duration) {
+	s.cooldown = cooldown
+}
+
+func (s *memoryStore) GetCooling(ctx context.Context) ([]net.IP, error) {
+	now := time.Now()
+	var results []net.IP
+	for ip, until := range s.pool.released {
+		if now.After(until) {
+			delete(s.pool.released, ip)
+			continue
+		}
+		results = append(results, net.ParseIP(ip))
+	}
+	return results, nil
+}
+
+func (s *memoryStore) GetLastHosts(ctx context.Context) (map[string]string, error) {
+	results := make(map[string]string, len(s.pool.hosts))
+	for ip, host := range s.pool.hosts {
+		results[ip] = host
+	}
+	return results, nil
+}
+
+func (s *memoryStore) GetBlocks(ctx context.Context) (map[string]string, error) {
+	results := make(map[string]string, len(s.pool.blocks))
+	for block, host := range s.pool.blocks {
+		results[block] = host
+	}
+	return results, nil
+}
+
+func (s *memoryStore) ClaimBlock(ctx context.Context, block *net.IPNet, host string) (bool, error) {
+	if _, ok := s.pool.blocks[block.String()]; ok {
+		return false, nil
+	}
+	s.pool.blocks[block.String()] = host
+	return true, nil
+}
+
+func (s *memoryStore) ReleaseBlock(ctx context.Context, block *net.IPNet, host string) error {
+	if s.pool.blocks[block.String()] == host {
+		delete(s.pool.blocks, block.String())
+	}
+	return nil
+}
+
+func (s *memoryStore) BlockInUse(ctx context.Context, block *net.IPNet) (bool, error) {
+	now := time.Now()
+	for ip, rec := range s.pool.endpoints {
+		if block.Contains(net.ParseIP(ip)) && !rec.Expired(now) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *memoryStore) GetByID(ctx context.Context, id string, ifname string) ([]net.IP, error) {
+	var result []net.IP
+	for ip, rec := range s.pool.endpoints {
+		if rec.Match(id, ifname) {
+			result = append(result, net.ParseIP(ip))
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) FindByID(ctx context.Context, id string, ifname string) (bool, error) {
+	ips, err := s.GetByID(ctx, id, ifname)
+	return len(ips) > 0, err
+}
+
+func (s *memoryStore) ListAllocations(ctx context.Context) ([]etcd.Allocation, error) {
+	s.pruneExpired(time.Now())
+	results := make([]etcd.Allocation, 0, len(s.pool.endpoints))
+	for ip, rec := range s.pool.endpoints {
+		results = append(results, etcd.Allocation{IP: net.ParseIP(ip), Record: rec})
+	}
+	return results, nil
+}
+
+func (s *memoryStore) GetAllEndpoins(ctx context.Context) ([]net.IP, error) {
+	now := time.Now()
+	results := make([]net.IP, 0, len(s.pool.endpoints))
+	for ip, rec := range s.pool.endpoints {
+		if !rec.Expired(now) {
+			results = append(results, net.ParseIP(ip))
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) Hold(ctx context.Context, id string, ifname string, grace time.Duration) error {
+	for ip, rec := range s.pool.endpoints {
+		if !rec.Match(id, ifname) {
+			continue
+		}
+		if rec.Identity == "" || grace <= 0 {
+			s.release(ip)
+			continue
+		}
+		s.pool.endpoints[ip] = rec.Hold(time.Now().Add(grace))
+	}
+	return nil
+}
+
+func (s *memoryStore) GetHeld(ctx context.Context, identity string) ([]net.IP, error) {
+	now := time.Now()
+	var results []net.IP
+	for ip, rec := range s.pool.endpoints {
+		if rec.Held() && rec.Identity == identity && !rec.Expired(now) {
+			results = append(results, net.ParseIP(ip))
+		}
+	}
+	return results, nil
+}
+
+func (s *memoryStore) Reclaim(ctx context.Context, rec *etcd.Record, ip net.IP) (bool, error) {
+	cur, ok := s.pool.endpoints[ip.String()]
+	if !ok || !cur.Held() || cur.Identity != rec.Identity || cur.Expired(time.Now()) {
+		return false, nil
+	}
+	s.pool.endpoints[ip.String()] = rec
+	return true, nil
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"neutron/pkg/etcd"
+	"neutron/pkg/log"
+)
+
+func TestMain(m *testing.M) {
+	log.InitCliLogger()
+	os.Exit(m.Run())
+}
+
+func TestMemoryReserve(t *testing.T) {
+	ctx := context.Background()
+	m := NewMemory()
+	s, err := m.Open(ctx, "svc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := net.ParseIP("10.0.0.2")
+	if ok, err := s.Reserve(ctx, &etcd.Record{ContainerID: "a", IfName: "eth0"}, ip); !ok || err != nil {
+		t.Fatalf("reserve: %t, %v", ok, err)
+	}
+	// 同一服务再次打开共享同一个池
+	s2, err := m.Open(ctx, "svc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s2.Reserve(ctx, &etcd.Record{ContainerID: "b", IfName: "eth0"}, ip); ok || err != nil {
+		t.Fatalf("reserve an allocated ip: %t, %v", ok, err)
+	}
+	// 不同服务的池互不影响
+	other, err := m.Open(ctx, "other", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := other.Reserve(ctx, &etcd.Record{ContainerID: "c", IfName: "eth0"}, ip); !ok || err != nil {
+		t.Fatalf("reserve in another service: %t, %v", ok, err)
+	}
+
+	if err := s2.ReleaseByID(ctx, "a", "eth0"); err != nil {
+		t.Fatal(err)
+	}
+	if ips, _ := s.GetAllEndpoins(ctx); len(ips) != 0 {
+		t.Errorf("released ip still allocated: %v", ips)
+	}
+}
+
+func TestMemoryPrunesExpiredHolds(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewMemory().Open(ctx, "svc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &etcd.Record{ContainerID: "a", IfName: "eth0", Identity: "web-0"}
+	if ok, err := s.Reserve(ctx, rec, net.ParseIP("10.0.0.2")); !ok || err != nil {
+		t.Fatalf("reserve: %t, %v", ok, err)
+	}
+	if err := s.Hold(ctx, "a", "eth0", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	allocs, err := s.ListAllocations(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocs) != 0 {
+		t.Errorf("expired hold not pruned: %+v", allocs)
+	}
+	if err := s.Lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.Unlock()
+	if held, _ := s.GetHeld(ctx, "web-0"); len(held) != 0 {
+		t.Errorf("expired hold still returned: %v", held)
+	}
+}
+
+func TestMemoryBlockInUse(t *testing.T) {
+	ctx := context.Background()
+	s, err := NewMemory().Open(ctx, "svc", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, block, _ := net.ParseCIDR("10.0.0.0/29")
+	rec := &etcd.Record{ContainerID: "a", IfName: "eth0", Identity: "web-0"}
+	if ok, err := s.Reserve(ctx, rec, net.ParseIP("10.0.0.2")); !ok || err != nil {
+		t.Fatalf("reserve: %t, %v", ok, err)
+	}
+	if inUse, err := s.BlockInUse(ctx, block); !inUse || err != nil {
+		t.Fatalf("block with an allocation: %t, %v", inUse, err)
+	}
+	// 粘性保留的ip仍占着块, 过期后块才空闲
+	if err := s.Hold(ctx, "a", "eth0", time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if inUse, err := s.BlockInUse(ctx, block); !inUse || err != nil {
+		t.Fatalf("block with a held ip: %t, %v", inUse, err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if inUse, err := s.BlockInUse(ctx, block); inUse || err != nil {
+		t.Errorf("block with an expired hold: %t, %v", inUse, err)
+	}
+}
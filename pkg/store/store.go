@@ -0,0 +1,71 @@
+// copyright @ 2020 ops inc.
+
+package store
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"neutron/pkg/config"
+	"neutron/pkg/etcd"
+)
+
+const (
+	STORE_ETCD   = "etcd"
+	STORE_DISK   = "disk"
+	STORE_MEMORY = "memory"
+)
+
+// Backend 存储后端: 读取服务配置, 并按服务打开etcd.Storager供allocator使用
+type Backend interface {
+	// GetServiceConf 获取服务的macvlan+ipam配置
+	GetServiceConf(ctx context.Context, service string) ([]byte, error)
+	// PutServiceConf 写入服务配置, 调用方需先校验
+	PutServiceConf(ctx context.Context, service string, conf []byte) error
+	// ListServices 获取有服务配置或有已分配ip的所有服务
+	ListServices(ctx context.Context) ([]string, error)
+	// Ping 检查存储是否可用, 代价要小(STATUS会频繁调用)
+	Ping(ctx context.Context) error
+	// Open 打开指定服务的ip存储
+	Open(ctx context.Context, service, podname string) (etcd.Storager, error)
+	Close() error
+}
+
+// Indexer Open返回的ip存储需要显式建立容器索引时(etcd)实现, 由neutronctl alloc index调用
+type Indexer interface {
+	BuildIndex(ctx context.Context) error
+}
+
+// Factory 根据本地配置创建存储后端
+type Factory func(conf *config.LocalConf) (Backend, error)
+
+var factories = map[string]Factory{}
+
+// Register 注册存储后端, 在各后端的init中调用
+func Register(name string, factory Factory) {
+	factories[name] = factory
+}
+
+// New 根据本地配置的store字段选择存储后端, 未配置时使用etcd
+func New(conf *config.LocalConf) (Backend, error) {
+	name := conf.Store
+	if name == "" {
+		name = STORE_ETCD
+	}
+
+	factory, ok := factories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown store backend: %q", name)
+	}
+	return factory(conf)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
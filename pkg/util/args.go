@@ -0,0 +1,82 @@
+// copyright @ 2020 ops inc.
+
+package util
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// CNIArgs CNI_ARGS解析结果, 如:
+// IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pay-10-online-84f8cc5d4b-8v4fw;K8S_POD_INFRA_CONTAINER_ID=xxx
+type CNIArgs struct {
+	types.CommonArgs
+	IP                         net.IP
+	K8S_POD_NAMESPACE          types.UnmarshallableString
+	K8S_POD_NAME               types.UnmarshallableString
+	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
+
+	// Custom 其余的key, 如identity配置的serviceKey、stageKey
+	Custom map[string]string
+}
+
+// knownArgs 由types.LoadArgs解析到CNIArgs字段的key
+var knownArgs = map[string]bool{
+	"IgnoreUnknown":              true,
+	"IP":                         true,
+	"K8S_POD_NAMESPACE":          true,
+	"K8S_POD_NAME":               true,
+	"K8S_POD_INFRA_CONTAINER_ID": true,
+}
+
+// ParseCNIArgs 解析CNI_ARGS, 格式错误时返回CNI错误(ErrInvalidEnvironmentVariables), 不会panic
+func ParseCNIArgs(envArgs string) (*CNIArgs, error) {
+	args := &CNIArgs{Custom: map[string]string{}}
+
+	var known []string
+	for _, pair := range strings.Split(envArgs, ";") {
+		if pair == "" {
+			continue
+		}
+		// 与types.LoadArgs一致, 值中不能再有'='
+		kv := strings.Split(pair, "=")
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, invalidArgs(fmt.Errorf("invalid pair %q, expect K=V", pair))
+		}
+		if knownArgs[kv[0]] {
+			known = append(known, pair)
+		} else {
+			args.Custom[kv[0]] = kv[1]
+		}
+	}
+
+	if err := types.LoadArgs(strings.Join(known, ";"), args); err != nil {
+		return nil, invalidArgs(err)
+	}
+	return args, nil
+}
+
+// Get 获取指定key的值, 不存在时返回空
+func (a *CNIArgs) Get(key string) string {
+	switch key {
+	case "IP":
+		if a.IP != nil {
+			return a.IP.String()
+		}
+		return ""
+	case "K8S_POD_NAMESPACE":
+		return string(a.K8S_POD_NAMESPACE)
+	case "K8S_POD_NAME":
+		return string(a.K8S_POD_NAME)
+	case "K8S_POD_INFRA_CONTAINER_ID":
+		return string(a.K8S_POD_INFRA_CONTAINER_ID)
+	}
+	return a.Custom[key]
+}
+
+func invalidArgs(err error) error {
+	return types.NewError(types.ErrInvalidEnvironmentVariables, "invalid CNI_ARGS", err.Error())
+}
@@ -0,0 +1,68 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestParseCNIArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    string
+		podName string
+		ip      string
+		custom  map[string]string
+		wantErr bool
+	}{
+		{name: "empty", args: ""},
+		{name: "only separators", args: ";;"},
+		{
+			name:    "kubelet args",
+			args:    "IgnoreUnknown=1;K8S_POD_NAMESPACE=default;K8S_POD_NAME=pay-10-online-84f8cc5d4b-8v4fw;K8S_POD_INFRA_CONTAINER_ID=abc",
+			podName: "pay-10-online-84f8cc5d4b-8v4fw",
+		},
+		{name: "empty value", args: "K8S_POD_NAME=;IP=", podName: ""},
+		{name: "value with =", args: "K8S_POD_NAME=a=b", wantErr: true},
+		{name: "custom value with =", args: "SERVICE=a=b", wantErr: true},
+		{name: "missing =", args: "K8S_POD_NAME", wantErr: true},
+		{name: "missing key", args: "=pay", wantErr: true},
+		{name: "trailing garbage", args: "K8S_POD_NAME=pay-1;oops", wantErr: true},
+		{name: "duplicate key, last wins", args: "K8S_POD_NAME=a;K8S_POD_NAME=b", podName: "b"},
+		{name: "duplicate custom key, last wins", args: "SERVICE=a;SERVICE=b", custom: map[string]string{"SERVICE": "b"}},
+		{name: "unknown keys kept", args: "SERVICE=pay;STAGE=", custom: map[string]string{"SERVICE": "pay", "STAGE": ""}},
+		{name: "ip", args: "IP=10.0.0.5", ip: "10.0.0.5"},
+		{name: "invalid ip", args: "IP=10.0.0", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args, err := ParseCNIArgs(tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want error", args)
+				}
+				if e, ok := err.(*types.Error); !ok || e.Code != types.ErrInvalidEnvironmentVariables {
+					t.Errorf("got error %#v, want a CNI ErrInvalidEnvironmentVariables", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := args.Get("K8S_POD_NAME"); got != tt.podName {
+				t.Errorf("K8S_POD_NAME = %q, want %q", got, tt.podName)
+			}
+			if got := args.Get("IP"); got != tt.ip {
+				t.Errorf("IP = %q, want %q", got, tt.ip)
+			}
+			for k, v := range tt.custom {
+				if got, ok := args.Custom[k]; !ok || got != v {
+					t.Errorf("custom %s = %q, want %q", k, got, v)
+				}
+			}
+			if len(args.Custom) != len(tt.custom) {
+				t.Errorf("custom = %v, want %v", args.Custom, tt.custom)
+			}
+		})
+	}
+}
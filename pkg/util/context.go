@@ -0,0 +1,24 @@
+// copyright @ 2020 ops inc.
+
+package util
+
+import (
+	"context"
+	"time"
+)
+
+// RollbackTimeout 回滚(释放已分配的ip)的超时时间
+const RollbackTimeout = 10 * time.Second
+
+// RollbackContext 回滚使用独立于本次调用的ctx, 调用超时(ctx到期)后仍能释放已分配的资源
+func RollbackContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), RollbackTimeout)
+}
+
+// ReplayTimeout ADD、DEL顺带重放之前未能释放的ip的时间上限, etcd较慢时不占用本次调用的时间
+const ReplayTimeout = 3 * time.Second
+
+// ReplayContext 重放使用的ctx, 不超过ReplayTimeout, 也不超过本次调用的ctx
+func ReplayContext(parent context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(parent, ReplayTimeout)
+}
@@ -0,0 +1,126 @@
+// copyright @ 2020 ops inc.
+
+package util
+
+import (
+	"fmt"
+	"regexp"
+
+	"neutron/pkg/log"
+)
+
+const (
+	IDENTITY_REGEX  = "regex"  // 用正则的命名分组从K8S_POD_NAME中提取(默认)
+	IDENTITY_ARGS   = "args"   // 从CNI_ARGS中指定的key读取
+	IDENTITY_LABELS = "labels" // 从runtimeConfig传入的pod labels/annotations中读取
+
+	// DefaultPodNameRegex 默认的pod命名: <服务名>-<数字>-<发布阶段>-<rs>-<pod>, 如pay-10-online-84f8cc5d4b-8v4fw
+	DefaultPodNameRegex = `^(?P<service>.+?)-\d+(?:-(?P<stage>[^-]+))?`
+)
+
+// IdentityConf 服务名、发布阶段的提取方式, 配置在本地插件配置的identity字段
+type IdentityConf struct {
+	Source     string `json:"source"`     // regex、args、labels, 默认regex
+	Regex      string `json:"regex"`      // source=regex: 包含service(必须)、stage命名分组的正则, 匹配K8S_POD_NAME
+	ServiceKey string `json:"serviceKey"` // source=args/labels: 服务名对应的key
+	StageKey   string `json:"stageKey"`   // source=args/labels: 发布阶段对应的key
+}
+
+// Identity 当前pod的服务名、发布阶段
+type Identity struct {
+	Service      string
+	Stage        string
+	PodName      string
+	PodNamespace string
+	Args         *CNIArgs // 解析后的CNI_ARGS
+}
+
+// Resolve 根据配置从CNI_ARGS、pod labels/annotations中解析当前pod的服务名和发布阶段.
+// conf为nil时使用默认的正则
+func (c *IdentityConf) Resolve(args *CNIArgs, labels, annotations map[string]string) (*Identity, error) {
+	if c == nil {
+		c = &IdentityConf{}
+	}
+
+	id := &Identity{
+		PodName:      string(args.K8S_POD_NAME),
+		PodNamespace: string(args.K8S_POD_NAMESPACE),
+		Args:         args,
+	}
+
+	switch c.Source {
+	case "", IDENTITY_REGEX:
+		if err := c.resolveRegex(id); err != nil {
+			return nil, err
+		}
+	case IDENTITY_ARGS:
+		if c.ServiceKey == "" {
+			return nil, fmt.Errorf("identity source %s requires serviceKey", c.Source)
+		}
+		id.Service = args.Get(c.ServiceKey)
+		if c.StageKey != "" {
+			id.Stage = args.Get(c.StageKey)
+		}
+	case IDENTITY_LABELS:
+		if c.ServiceKey == "" {
+			return nil, fmt.Errorf("identity source %s requires serviceKey", c.Source)
+		}
+		id.Service = lookup(c.ServiceKey, labels, annotations)
+		if c.StageKey != "" {
+			id.Stage = lookup(c.StageKey, labels, annotations)
+		}
+	default:
+		return nil, fmt.Errorf("unknown identity source: %q", c.Source)
+	}
+
+	if id.Service == "" {
+		return nil, fmt.Errorf("can not get service name of pod %q by identity source %q", id.PodName, c.Source)
+	}
+	log.Infof("Get current service: %s stage: %s pod: %s", id.Service, id.Stage, id.PodName)
+	return id, nil
+}
+
+func (c *IdentityConf) resolveRegex(id *Identity) error {
+	pattern := c.Regex
+	if pattern == "" {
+		pattern = DefaultPodNameRegex
+	}
+	reg, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid identity regex %q: %v", pattern, err)
+	}
+	if subexpIndex(reg, "service") < 0 {
+		return fmt.Errorf("identity regex %q has no (?P<service>...) group", pattern)
+	}
+
+	if id.PodName == "" {
+		return fmt.Errorf("K8S_POD_NAME is missing in CNI_ARGS")
+	}
+	match := reg.FindStringSubmatch(id.PodName)
+	if match == nil {
+		return fmt.Errorf("pod name %q does not match identity regex %q", id.PodName, pattern)
+	}
+	id.Service = match[subexpIndex(reg, "service")]
+	if idx := subexpIndex(reg, "stage"); idx >= 0 {
+		id.Stage = match[idx]
+	}
+	return nil
+}
+
+// subexpIndex 返回命名分组的下标, 不存在时返回-1
+func subexpIndex(reg *regexp.Regexp, name string) int {
+	for i, n := range reg.SubexpNames() {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup 先从labels中查找, 再从annotations中查找
+func lookup(key string, labels, annotations map[string]string) string {
+	if v, ok := labels[key]; ok {
+		return v
+	}
+	return annotations[key]
+}
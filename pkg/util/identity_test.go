@@ -0,0 +1,101 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+func TestResolveIdentity(t *testing.T) {
+	tests := []struct {
+		name        string
+		conf        *IdentityConf
+		podName     string
+		custom      map[string]string
+		labels      map[string]string
+		annotations map[string]string
+		service     string
+		stage       string
+		wantErr     string
+	}{
+		{
+			name:    "default regex deployment pod",
+			podName: "pay-10-online-84f8cc5d4b-8v4fw",
+			service: "pay",
+			stage:   "online",
+		},
+		{
+			// StatefulSet的pod名以序号结尾, 没有发布阶段
+			name:    "default regex ordinal pod",
+			podName: "db-2",
+			service: "db",
+		},
+		{
+			name:    "missing pod name",
+			wantErr: "K8S_POD_NAME is missing",
+		},
+		{
+			name:    "pod name not matched",
+			podName: "pay",
+			wantErr: `pod name "pay" does not match`,
+		},
+		{
+			name:    "custom regex",
+			conf:    &IdentityConf{Regex: `^(?P<stage>[a-z]+)-(?P<service>[a-z]+)-`},
+			podName: "gray-pay-84f8cc5d4b-8v4fw",
+			service: "pay",
+			stage:   "gray",
+		},
+		{
+			name:    "regex without service group",
+			conf:    &IdentityConf{Regex: `^(?P<stage>[a-z]+)-`},
+			podName: "gray-pay",
+			wantErr: "has no (?P<service>...) group",
+		},
+		{
+			name:    "args",
+			conf:    &IdentityConf{Source: IDENTITY_ARGS, ServiceKey: "SERVICE", StageKey: "STAGE"},
+			custom:  map[string]string{"SERVICE": "pay", "STAGE": "sandbox"},
+			service: "pay",
+			stage:   "sandbox",
+		},
+		{
+			name:    "args missing service",
+			conf:    &IdentityConf{Source: IDENTITY_ARGS, ServiceKey: "SERVICE"},
+			podName: "pay-10-online-84f8cc5d4b-8v4fw",
+			wantErr: "can not get service name",
+		},
+		{
+			name:        "labels then annotations",
+			conf:        &IdentityConf{Source: IDENTITY_LABELS, ServiceKey: "app", StageKey: "stage"},
+			labels:      map[string]string{"app": "pay"},
+			annotations: map[string]string{"app": "ignored", "stage": "canary"},
+			service:     "pay",
+			stage:       "canary",
+		},
+		{
+			name:    "unknown source",
+			conf:    &IdentityConf{Source: "dns"},
+			wantErr: "unknown identity source",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := &CNIArgs{K8S_POD_NAME: types.UnmarshallableString(tt.podName), Custom: tt.custom}
+			id, err := tt.conf.Resolve(args, tt.labels, tt.annotations)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if id.Service != tt.service || id.Stage != tt.stage {
+				t.Errorf("got service %q stage %q, want %q %q", id.Service, id.Stage, tt.service, tt.stage)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+// copyright @ 2020 ops inc.
+
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"neutron/pkg/log"
+)
+
+// Undo 记录一次调用中已经生效的副作用(创建的网卡、分配的ip等), 失败时按相反的顺序撤销
+type Undo struct {
+	steps []undoStep
+}
+
+type undoStep struct {
+	name string
+	fn   func() error
+}
+
+// Push 副作用生效后(或即将生效前)登记对应的撤销操作, 撤销操作需要能容忍副作用只完成了一部分
+func (u *Undo) Push(name string, fn func() error) {
+	u.steps = append(u.steps, undoStep{name: name, fn: fn})
+}
+
+// Unwind 从最后一步开始依次撤销, 某一步失败时记录日志并继续撤销之前的步骤, 最后返回所有失败的步骤
+func (u *Undo) Unwind() error {
+	var errs []string
+	for i := len(u.steps) - 1; i >= 0; i-- {
+		step := u.steps[i]
+		if err := step.fn(); err != nil {
+			log.Warnf("Undo %s failed: %v", step.name, err)
+			errs = append(errs, fmt.Sprintf("%s: %v", step.name, err))
+			continue
+		}
+		log.Infof("Undo %s success", step.name)
+	}
+	u.steps = nil
+	if len(errs) > 0 {
+		return fmt.Errorf("undo failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"neutron/pkg/log"
+)
+
+func TestMain(m *testing.M) {
+	log.InitCliLogger()
+	os.Exit(m.Run())
+}
+
+func TestUnwindOrder(t *testing.T) {
+	var undone []string
+	u := &Undo{}
+	for _, name := range []string{"vlan", "macvlan", "ipam"} {
+		name := name
+		u.Push(name, func() error {
+			undone = append(undone, name)
+			return nil
+		})
+	}
+	if err := u.Unwind(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := []string{"ipam", "macvlan", "vlan"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("undone %v, want %v", undone, want)
+	}
+
+	// 撤销后清空, 再次Unwind不会重复执行
+	undone = nil
+	if err := u.Unwind(); err != nil || undone != nil {
+		t.Errorf("second unwind: undone %v, err %v", undone, err)
+	}
+}
+
+func TestUnwindAggregatesErrors(t *testing.T) {
+	var undone []string
+	u := &Undo{}
+	step := func(name string, err error) {
+		u.Push(name, func() error {
+			undone = append(undone, name)
+			return err
+		})
+	}
+	step("vlan", errors.New("busy"))
+	step("macvlan", nil)
+	step("ipam", errors.New("etcd unavailable"))
+
+	err := u.Unwind()
+	// 某一步失败后继续撤销之前的步骤
+	if want := []string{"ipam", "macvlan", "vlan"}; !reflect.DeepEqual(undone, want) {
+		t.Errorf("undone %v, want %v", undone, want)
+	}
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{"ipam: etcd unavailable", "vlan: busy"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "macvlan") {
+		t.Errorf("error %q contains the successful step", err)
+	}
+}
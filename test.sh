@@ -20,7 +20,7 @@ export CNI_COMMAND=ADD
 # 本机macvlan配置如下:
 #[root@dx-kvm00 neutron]# cat /etc/cni/net.d/10-maclannet.conf
 #{
-#    "cniVersion":"0.3.1",
+#    "cniVersion":"1.0.0",
 #    "name": "neutron",
 #    "type": "neutron",
 #    "etcd": {